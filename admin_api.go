@@ -0,0 +1,481 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/labstack/echo.v1"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The admin API lets operators manage every user and key, as opposed to the
+// portal API where users only manage themselves. It takes the same tokens as the
+// portal API, but only from users marked as admins.
+type adminAPI struct {
+	portal *portalAPI
+	m      AdminBackendPlugin
+	a      *apiplex
+}
+
+type adminKey struct {
+	Key   *Key         `json:"key"`
+	Owner string       `json:"owner"`
+	Quota apiplexQuota `json:"quota"`
+}
+
+// the EWMA state of a quota counter in redis. Avg is the current rate in requests
+// per quota period, Last the unix time of the last request counted.
+type quotaState struct {
+	Avg  float64 `json:"avg"`
+	Last int64   `json:"last,omitempty"`
+}
+
+type keyUsage struct {
+	Quota apiplexQuota          `json:"quota"`
+	Key   quotaState            `json:"key"`
+	IPs   map[string]quotaState `json:"ips"`
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+func page(c *echo.Context) (offset, limit int) {
+	offset, _ = strconv.Atoi(c.Query("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit, _ = strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = defaultPageSize
+	} else if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return
+}
+
+func (a *adminAPI) withQuota(k *Key) adminKey {
+	q, ok := a.a.quotas[k.Quota]
+	if !ok {
+		q = a.a.quotas["default"]
+	}
+	return adminKey{Key: k, Owner: k.Owner, Quota: q}
+}
+
+func (a *adminAPI) listUsers(c *echo.Context) {
+	res := c.Response().Writer()
+	offset, limit := page(c)
+	users, err := a.m.FindUsers(c.Query("q"), offset, limit)
+	if err != nil {
+		abort(res, 500, "Could not search users: %s", err.Error())
+		return
+	}
+	if users == nil {
+		users = []*User{}
+	}
+	finish(res, users)
+}
+
+func (a *adminAPI) getUser(c *echo.Context) {
+	res := c.Response().Writer()
+	email := c.Param("email")
+	u := a.m.GetUser(email)
+	if u == nil {
+		abort(res, 404, "User '%s' not found.", email)
+		return
+	}
+	keys, err := a.m.GetAllKeys(email)
+	if err != nil {
+		abort(res, 500, err.Error())
+		return
+	}
+	aks := make([]adminKey, len(keys))
+	for i, k := range keys {
+		if k.Owner == "" {
+			k.Owner = email
+		}
+		aks[i] = a.withQuota(k)
+	}
+	finish(res, map[string]interface{}{"user": u, "keys": aks})
+}
+
+func (a *adminAPI) setUserActive(active bool) func(*echo.Context) {
+	return func(c *echo.Context) {
+		res := c.Response().Writer()
+		email := c.Param("email")
+		if a.m.GetUser(email) == nil {
+			abort(res, 404, "User '%s' not found.", email)
+			return
+		}
+		if err := a.m.SetUserActive(email, active); err != nil {
+			abort(res, 500, "Could not update user: %s", err.Error())
+			return
+		}
+		rd := a.a.redis.Get()
+		defer rd.Close()
+		if err := a.a.invalidateUserKeys(rd, email); err != nil {
+			abort(res, 500, "The user was updated, but their keys may not notice for a while: %s", err.Error())
+			return
+		}
+		finish(res, a.m.GetUser(email))
+	}
+}
+
+func (a *adminAPI) deleteUser(c *echo.Context) {
+	res := c.Response().Writer()
+	email := c.Param("email")
+	if a.m.GetUser(email) == nil {
+		abort(res, 404, "User '%s' not found.", email)
+		return
+	}
+	keys, err := a.m.GetAllKeys(email)
+	if err != nil {
+		abort(res, 500, err.Error())
+		return
+	}
+	if err := a.m.DeleteUser(email); err != nil {
+		abort(res, 500, "Could not delete user: %s", err.Error())
+		return
+	}
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	for _, k := range keys {
+		if err := a.a.revokeKey(rd, k.ID); err != nil {
+			abort(res, 500, "The user was deleted, but their keys may keep working for a while: %s", err.Error())
+			return
+		}
+	}
+	finish(res, map[string]interface{}{"deleted": email})
+}
+
+// creates a key for a user, as if they had asked for it in the portal. Admins
+// may also pick the key's quota.
+func (a *adminAPI) issueKey(c *echo.Context) {
+	res := c.Response().Writer()
+	email := c.Param("email")
+	r := struct {
+		Type  string `json:"type"`
+		Realm string `json:"realm"`
+		Quota string `json:"quota"`
+	}{}
+	if json.NewDecoder(c.Request().Body).Decode(&r) != nil || r.Type == "" {
+		abort(res, 400, "Specify a key type.")
+		return
+	}
+	if a.m.GetUser(email) == nil {
+		abort(res, 404, "User '%s' not found.", email)
+		return
+	}
+	plugin, found := a.portal.keyplugins[r.Type]
+	if !found {
+		abort(res, 400, "The requested key type is not available for creation.")
+		return
+	}
+	if r.Quota != "" {
+		if _, ok := a.a.quotas[r.Quota]; !ok {
+			abort(res, 400, "There is no quota named '%s'.", r.Quota)
+			return
+		}
+	}
+	key, err := plugin.Generate(r.Type)
+	if err != nil {
+		abort(res, 500, "Could not create %s key: %s", r.Type, err.Error())
+		return
+	}
+	key.Realm = r.Realm
+	if r.Quota != "" {
+		key.Quota = r.Quota
+	}
+	key.Owner = email
+	if err = a.m.AddKey(email, &key); err != nil {
+		abort(res, 500, "The new key could not be stored. %s", err.Error())
+		return
+	}
+	finish(res, a.withQuota(&key))
+}
+
+func (a *adminAPI) listKeys(c *echo.Context) {
+	res := c.Response().Writer()
+	offset, limit := page(c)
+	keys, err := a.m.FindKeys(c.Query("q"), offset, limit)
+	if err != nil {
+		abort(res, 500, "Could not search keys: %s", err.Error())
+		return
+	}
+	aks := make([]adminKey, len(keys))
+	for i, k := range keys {
+		aks[i] = a.withQuota(k)
+	}
+	finish(res, aks)
+}
+
+// finds the key the request is about, or answers with an error
+func (a *adminAPI) findKey(c *echo.Context) *Key {
+	res := c.Response().Writer()
+	kid := c.Param("id")
+	key, err := a.m.GetKeyByID(kid)
+	if err != nil {
+		abort(res, 500, err.Error())
+		return nil
+	}
+	if key == nil {
+		abort(res, 404, "Key '%s' not found.", kid)
+		return nil
+	}
+	return key
+}
+
+func (a *adminAPI) getKey(c *echo.Context) {
+	if key := a.findKey(c); key != nil {
+		finish(c.Response().Writer(), a.withQuota(key))
+	}
+}
+
+func (a *adminAPI) setKeySuspended(suspended bool) func(*echo.Context) {
+	return func(c *echo.Context) {
+		key := a.findKey(c)
+		if key == nil {
+			return
+		}
+		key.Suspended = suspended
+		a.updateKey(c.Response().Writer(), key)
+	}
+}
+
+func (a *adminAPI) setKeyQuota(c *echo.Context) {
+	res := c.Response().Writer()
+	r := struct {
+		Quota string `json:"quota"`
+	}{}
+	if json.NewDecoder(c.Request().Body).Decode(&r) != nil || r.Quota == "" {
+		abort(res, 400, "Specify the name of the key's new quota.")
+		return
+	}
+	if _, ok := a.a.quotas[r.Quota]; !ok {
+		abort(res, 400, "There is no quota named '%s'.", r.Quota)
+		return
+	}
+	key := a.findKey(c)
+	if key == nil {
+		return
+	}
+	key.Quota = r.Quota
+	a.updateKey(res, key)
+}
+
+// stores a changed key, and makes sure the change takes effect right away
+func (a *adminAPI) updateKey(res http.ResponseWriter, key *Key) {
+	if err := a.m.UpdateKey(key); err != nil {
+		abort(res, 500, "Could not update key: %s", err.Error())
+		return
+	}
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	if err := a.a.invalidateKeys(rd, key.ID); err != nil {
+		abort(res, 500, "The key was updated, but the change may not take effect for a while: %s", err.Error())
+		return
+	}
+	finish(res, a.withQuota(key))
+}
+
+func (a *adminAPI) deleteKey(c *echo.Context) {
+	res := c.Response().Writer()
+	key := a.findKey(c)
+	if key == nil {
+		return
+	}
+	if err := a.m.DeleteKey(key.Owner, key.ID); err != nil {
+		abort(res, 500, "Could not delete key: %s", err.Error())
+		return
+	}
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	if err := a.a.revokeKey(rd, key.ID); err != nil {
+		abort(res, 500, "The key was deleted, but may keep working for a while: %s", err.Error())
+		return
+	}
+	finish(res, map[string]interface{}{"deleted": key.ID})
+}
+
+func (a *adminAPI) listRevoked(c *echo.Context) {
+	res := c.Response().Writer()
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	revoked, err := redis.Strings(rd.Do("SMEMBERS", revokedKeys))
+	if err != nil {
+		abort(res, 500, err.Error())
+		return
+	}
+	if revoked == nil {
+		revoked = []string{}
+	}
+	finish(res, revoked)
+}
+
+// revokes any key, even one that lives in a backend apiplexy can't change
+func (a *adminAPI) revoke(c *echo.Context) {
+	res := c.Response().Writer()
+	r := struct {
+		KID string `json:"key_id"`
+	}{}
+	if json.NewDecoder(c.Request().Body).Decode(&r) != nil || r.KID == "" {
+		abort(res, 400, "Specify a key_id to revoke.")
+		return
+	}
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	if err := a.a.revokeKey(rd, r.KID); err != nil {
+		abort(res, 500, "Could not revoke key: %s", err.Error())
+		return
+	}
+	finish(res, map[string]interface{}{"revoked": r.KID})
+}
+
+func (a *adminAPI) unrevoke(c *echo.Context) {
+	res := c.Response().Writer()
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	if err := a.a.unrevokeKey(rd, c.Param("id")); err != nil {
+		abort(res, 500, "Could not take back revocation: %s", err.Error())
+		return
+	}
+	finish(res, map[string]interface{}{"unrevoked": c.Param("id")})
+}
+
+// finds the redis keys of a key's per-IP quota counters, by client IP
+func ipQuotaKeys(rd redis.Conn, keyID string) (map[string]string, error) {
+	prefix := "quota:ip:" + keyID + ":"
+	found := make(map[string]string)
+	cursor := 0
+	for {
+		values, err := redis.Values(rd.Do("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*:avg", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		if _, err := redis.Scan(values, &cursor, &names); err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			base := strings.TrimSuffix(n, ":avg")
+			found[strings.TrimPrefix(base, prefix)] = base
+		}
+		if cursor == 0 {
+			return found, nil
+		}
+	}
+}
+
+func readQuotaState(rd redis.Conn, base string) (quotaState, error) {
+	qs := quotaState{}
+	values, err := redis.Values(rd.Do("MGET", base+":avg", base+":ts"))
+	if err != nil {
+		return qs, err
+	}
+	avg, _ := redis.Float64(values[0], nil)
+	last, _ := redis.Int64(values[1], nil)
+	qs.Avg, qs.Last = avg, last
+	return qs, nil
+}
+
+func (a *adminAPI) getUsage(c *echo.Context) {
+	res := c.Response().Writer()
+	key := a.findKey(c)
+	if key == nil {
+		return
+	}
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	usage := keyUsage{Quota: a.withQuota(key).Quota, IPs: make(map[string]quotaState)}
+	var err error
+	if usage.Key, err = readQuotaState(rd, "quota:key:"+key.ID); err != nil {
+		abort(res, 500, err.Error())
+		return
+	}
+	ips, err := ipQuotaKeys(rd, key.ID)
+	if err != nil {
+		abort(res, 500, err.Error())
+		return
+	}
+	for ip, base := range ips {
+		if usage.IPs[ip], err = readQuotaState(rd, base); err != nil {
+			abort(res, 500, err.Error())
+			return
+		}
+	}
+	finish(res, &usage)
+}
+
+// resets a key's quota counters, so it starts over with a clean slate
+func (a *adminAPI) resetUsage(c *echo.Context) {
+	res := c.Response().Writer()
+	key := a.findKey(c)
+	if key == nil {
+		return
+	}
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	base := "quota:key:" + key.ID
+	del := []interface{}{base + ":avg", base + ":ts", base + ":notified"}
+	ips, err := ipQuotaKeys(rd, key.ID)
+	if err != nil {
+		abort(res, 500, err.Error())
+		return
+	}
+	for _, ipBase := range ips {
+		del = append(del, ipBase+":avg", ipBase+":ts")
+	}
+	if _, err := rd.Do("DEL", del...); err != nil {
+		abort(res, 500, "Could not reset quota: %s", err.Error())
+		return
+	}
+	finish(res, map[string]interface{}{"reset": key.ID})
+}
+
+func (a *adminAPI) auth(inner func(*echo.Context)) func(*echo.Context) error {
+	return func(c *echo.Context) error {
+		return a.portal.auth(func(email string, res http.ResponseWriter, req *http.Request) {
+			if u := a.m.GetUser(email); u == nil || !u.Active || !u.Admin {
+				abort(res, 403, "Access denied: the admin API is only open to administrators.")
+				return
+			}
+			inner(c)
+		})(c)
+	}
+}
+
+func (ap *apiplex) BuildAdminAPI(mux *echo.Echo, path string) (*echo.Group, error) {
+	m, ok := ap.usermgmt.(AdminBackendPlugin)
+	if !ok {
+		return nil, fmt.Errorf("There is no backend plugin that supports user administration.")
+	}
+	p, err := ap.buildPortalAPI()
+	if err != nil {
+		return nil, err
+	}
+	a := &adminAPI{portal: p, m: m, a: ap}
+
+	r := mux.Group(path)
+	r.Get("/users", a.auth(a.listUsers))
+	r.Get("/users/:email", a.auth(a.getUser))
+	r.Delete("/users/:email", a.auth(a.deleteUser))
+	r.Post("/users/:email/activate", a.auth(a.setUserActive(true)))
+	r.Post("/users/:email/suspend", a.auth(a.setUserActive(false)))
+	r.Post("/users/:email/keys", a.auth(a.issueKey))
+	r.Get("/keys", a.auth(a.listKeys))
+	r.Get("/keys/:id", a.auth(a.getKey))
+	r.Delete("/keys/:id", a.auth(a.deleteKey))
+	r.Post("/keys/:id/activate", a.auth(a.setKeySuspended(false)))
+	r.Post("/keys/:id/suspend", a.auth(a.setKeySuspended(true)))
+	r.Post("/keys/:id/quota", a.auth(a.setKeyQuota))
+	r.Get("/keys/:id/usage", a.auth(a.getUsage))
+	r.Delete("/keys/:id/usage", a.auth(a.resetUsage))
+	r.Get("/revoked", a.auth(a.listRevoked))
+	r.Post("/revoked", a.auth(a.revoke))
+	r.Delete("/revoked/:id", a.auth(a.unrevoke))
+
+	return r, nil
+}
@@ -0,0 +1,100 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+// a redis connection that only knows GET, SET(EX), DEL and a little about sets
+type memoryRedis map[string]string
+
+func (m memoryRedis) Close() error                               { return nil }
+func (m memoryRedis) Err() error                                 { return nil }
+func (m memoryRedis) Send(cmd string, args ...interface{}) error { return nil }
+func (m memoryRedis) Flush() error                               { return nil }
+func (m memoryRedis) Receive() (interface{}, error)              { return nil, nil }
+func (m memoryRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "GET":
+		if v, ok := m[args[0].(string)]; ok {
+			return []byte(v), nil
+		}
+	case "SET":
+		m[args[0].(string)] = args[1].(string)
+	case "SETEX":
+		m[args[0].(string)] = args[2].(string)
+	case "DEL":
+		for _, k := range args {
+			delete(m, k.(string))
+		}
+	case "SADD":
+		m[args[0].(string)+"|"+args[1].(string)] = "1"
+	case "SREM":
+		delete(m, args[0].(string)+"|"+args[1].(string))
+	case "SISMEMBER":
+		if _, ok := m[args[0].(string)+"|"+args[1].(string)]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, nil
+}
+
+// finds a key in the Authorization header, and takes any key it's given
+type headerAuth struct{}
+
+func (a *headerAuth) DefaultConfig() map[string]interface{}         { return nil }
+func (a *headerAuth) Configure(config map[string]interface{}) error { return nil }
+func (a *headerAuth) AvailableTypes() []KeyType                     { return []KeyType{{Name: "Test"}} }
+func (a *headerAuth) Generate(keyType string) (Key, error)          { return Key{ID: "new", Type: keyType}, nil }
+func (a *headerAuth) Detect(req *http.Request, ctx *APIContext) (string, string, map[string]interface{}, error) {
+	return req.Header.Get("Authorization"), "Test", nil, nil
+}
+func (a *headerAuth) Validate(key *Key, req *http.Request, ctx *APIContext, authCtx map[string]interface{}) (bool, error) {
+	return true, nil
+}
+
+type staticKeys map[string]*Key
+
+func (b staticKeys) DefaultConfig() map[string]interface{}         { return nil }
+func (b staticKeys) Configure(config map[string]interface{}) error { return nil }
+func (b staticKeys) GetKey(keyID string, keyType string) (*Key, error) {
+	return b[keyID], nil
+}
+
+func TestSuspendedKeys(t *testing.T) {
+	ap := &apiplex{
+		authCacheTTL: 600,
+		backends: []BackendPlugin{staticKeys{
+			"good":      &Key{ID: "good", Type: "Test"},
+			"suspended": &Key{ID: "suspended", Type: "Test", Suspended: true},
+		}},
+	}
+	chains := &pluginChains{auth: []AuthPlugin{&headerAuth{}}}
+	authenticate := func(rd memoryRedis, key string) (*APIContext, error) {
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		req.Header.Set("Authorization", key)
+		ctx := &APIContext{}
+		return ctx, ap.authenticateRequest(req, rd, ctx, chains)
+	}
+
+	Convey("Keys that aren't suspended should be let through", t, func() {
+		ctx, err := authenticate(memoryRedis{}, "good")
+		So(err, ShouldBeNil)
+		So(ctx.Key.ID, ShouldEqual, "good")
+	})
+
+	Convey("Suspended keys should be turned away", t, func() {
+		_, err := authenticate(memoryRedis{}, "suspended")
+		So(err, ShouldNotBeNil)
+		So(err.(AbortRequest).Status, ShouldEqual, 403)
+	})
+
+	Convey("Suspended keys should be turned away from the auth cache as well", t, func() {
+		kjson, _ := json.Marshal(&Key{ID: "cached", Type: "Test", Suspended: true})
+		_, err := authenticate(memoryRedis{"auth_cache:cached": string(kjson)}, "cached")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -9,6 +9,8 @@ import (
 )
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/12foo/apiplexy"
 	"github.com/codegangsta/cli"
@@ -18,8 +20,12 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -96,15 +102,23 @@ func fileOrPid(maybe string) (int, error) {
 	return 0, nil
 }
 
-func initApiplex(configPath string) (http.Handler, apiplexy.ApiplexConfig, error) {
+func loadConfig(configPath string) (apiplexy.ApiplexConfig, error) {
 	yml, err := ioutil.ReadFile(os.ExpandEnv(configPath))
 	config := apiplexy.ApiplexConfig{}
 	if err != nil {
-		return nil, config, fmt.Errorf("Couldn't read config file: %s\n", err.Error())
+		return config, fmt.Errorf("Couldn't read config file: %s\n", err.Error())
 	}
 	err = yaml.Unmarshal(yml, &config)
 	if err != nil {
-		return nil, config, fmt.Errorf("Couldn't parse configuration: %s\n", err.Error())
+		return config, fmt.Errorf("Couldn't parse configuration: %s\n", err.Error())
+	}
+	return config, nil
+}
+
+func initApiplex(configPath string) (apiplexy.Gateway, apiplexy.ApiplexConfig, error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, config, err
 	}
 	ap, err := apiplexy.New(config)
 	if err != nil {
@@ -114,50 +128,375 @@ func initApiplex(configPath string) (http.Handler, apiplexy.ApiplexConfig, error
 }
 
 func check(c *cli.Context) {
-	if _, _, err := initApiplex(c.String("config")); err != nil {
+	_, config, err := initApiplex(c.String("config"))
+	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
+	warnings := apiplexy.RouteWarnings(config)
+	if len(warnings) > 0 {
+		fmt.Printf("Configuration works, but check your routes:\n\n")
+		for _, w := range warnings {
+			fmt.Printf("   - %s\n", w)
+		}
+		fmt.Println()
+		os.Exit(0)
+	}
 	fmt.Println("All OK.")
 	os.Exit(0)
 }
 
+func reload(c *cli.Context) {
+	pid, err := fileOrPid(c.String("pidfile"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if pid == 0 {
+		fmt.Fprintf(os.Stderr, "No running apiplexy found at '%s'.\n", c.String("pidfile"))
+		os.Exit(1)
+	}
+	if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't signal apiplexy at PID %d: %s\n", pid, err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Asked apiplexy at PID %d to reload its configuration. Errors, if any, show up in its output.\n", pid)
+}
+
+func purgeCache(c *cli.Context) {
+	config, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	prefix := ""
+	if len(c.Args()) > 0 {
+		prefix = c.Args()[0]
+	}
+	n, err := apiplexy.PurgeCache(config, prefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't purge cache: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Purged %d cached responses.\n", n)
+}
+
+func traceRewrite(c *cli.Context) {
+	config, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if len(c.Args()) == 0 {
+		fmt.Fprintf(os.Stderr, "Please give a URL or path to try, e.g. http://api.example.com/v1/users/42\n")
+		os.Exit(1)
+	}
+	header := http.Header{}
+	for _, h := range c.StringSlice("header") {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 {
+			fmt.Fprintf(os.Stderr, "Headers should look like 'Name: value', not '%s'.\n", h)
+			os.Exit(1)
+		}
+		header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	t, err := apiplexy.TraceRewrite(config, c.String("method"), c.Args()[0], header)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if t.VHost != "" {
+		fmt.Fprintf(w, "Virtual host:\t%s\n", t.VHost)
+	}
+	fmt.Fprintf(w, "API path:\t%s\n", t.APIPath)
+	if t.Rule != "" {
+		fmt.Fprintf(w, "Rewrite rule:\t%s\n", t.Rule)
+	} else {
+		fmt.Fprintf(w, "Rewrite rule:\t(none)\n")
+	}
+	fmt.Fprintf(w, "Upstream URL:\t%s\n", t.URL)
+	names := make([]string, 0, len(t.Header))
+	for k := range t.Header {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(w, "  %s:\t%s\n", k, strings.Join(t.Header[k], ", "))
+	}
+	w.Flush()
+}
+
+// A graceful restart hands the listening sockets to the new process, starting at
+// fd 3, in the order of the addresses listed in this variable. The new process
+// reports back on the next fd once it's serving.
+const listenersEnv = "APIPLEXY_LISTENERS"
+
+// A graceful restart that names a config file leaves its path next to the pidfile,
+// for the running apiplexy to pass on to its replacement.
+func restartConfigFile(pidfile string) string {
+	return pidfile + ".config"
+}
+
+// Leaves the config path for the running apiplexy. The file is created fresh, so
+// nothing planted there beforehand (like a symlink) gets written through.
+func passConfigPath(pidfile, configPath string) error {
+	path, err := filepath.Abs(os.ExpandEnv(configPath))
+	if err != nil {
+		return err
+	}
+	os.Remove(restartConfigFile(pidfile))
+	f, err := os.OpenFile(restartConfigFile(pidfile), os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(path)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Picks up (and removes) a config path left for a graceful restart. Returns ""
+// if there is none, or if the file isn't a regular file of our own user's.
+func takeConfigPath(pidfile string) string {
+	name := restartConfigFile(pidfile)
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	defer os.Remove(name)
+	fi, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.Mode().IsRegular() || !ok || int(st.Uid) != os.Getuid() {
+		fmt.Fprintf(os.Stderr, "Ignoring '%s', which isn't a file of ours.\n", name)
+		return ""
+	}
+	path, err := ioutil.ReadAll(f)
+	if err != nil {
+		return ""
+	}
+	return string(path)
+}
+
+// A server and the socket it listens on.
+type listener struct {
+	addr   string
+	l      net.Listener
+	server *http.Server
+}
+
+// Picks up the sockets passed on by a previous apiplexy, and the pipe to tell it
+// we're ready.
+func inheritedListeners() (map[string]net.Listener, *os.File) {
+	env := os.Getenv(listenersEnv)
+	os.Unsetenv(listenersEnv)
+	inherited := make(map[string]net.Listener)
+	if env == "" {
+		return inherited, nil
+	}
+	addrs := strings.Split(env, ",")
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't take over socket for %s: %s\n", addr, err.Error())
+			continue
+		}
+		inherited[addr] = l
+	}
+	return inherited, os.NewFile(uintptr(3+len(addrs)), "ready")
+}
+
+// Starts a new apiplexy that takes over our sockets, and waits until it's up.
+func spawnReplacement(listeners []*listener, configPath string) error {
+	files := []*os.File{}
+	addrs := []string{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		f, err := l.l.(*net.TCPListener).File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		addrs = append(addrs, l.addr)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(exe, "start", "-g", "--config", configPath, "--pidfile", pidfile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), listenersEnv+"="+strings.Join(addrs, ","))
+	cmd.ExtraFiles = append(files, readyW)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("the new process exited before it was ready")
+	}
+	return nil
+}
+
+// Stops accepting connections, waits for in-flight requests (up to the deadline)
+// and then shuts down the plugins.
+func drain(listeners []*listener, ap apiplexy.Gateway, timeout time.Duration) {
+	// one deadline for the whole drain: whatever the servers leave of it goes
+	// to the gateway
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan bool)
+	for _, l := range listeners {
+		go func(server *http.Server) {
+			if err := server.Shutdown(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "Gave up waiting for requests to finish: %s\n", err.Error())
+			}
+			done <- true
+		}(l.server)
+	}
+	for range listeners {
+		<-done
+	}
+	ap.Shutdown(ctx)
+}
+
 func start(c *cli.Context) {
+	pidfile = c.String("pidfile")
+	if configPath == "" {
+		configPath = c.String("config")
+	}
+	inherited, ready := inheritedListeners()
+
 	if pidfile != "" {
 		pid, err := fileOrPid(pidfile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, err.Error())
 			os.Exit(1)
 		}
-		if pid != 0 && pid != syscall.Getppid() {
-			fmt.Fprintf(os.Stderr, "There is already a pidfile at '%s' that appears to belong to another apiplexy instance.")
+		running := pid != 0 && syscall.Kill(pid, 0) == nil
+		if c.Bool("g") && ready == nil {
+			// the running apiplexy starts its own replacement, so it can hand over the socket
+			if running {
+				if c.IsSet("config") {
+					// the replacement runs wherever the running apiplexy does
+					err := fmt.Errorf("a PID was given instead of a pidfile")
+					if _, serr := strconv.Atoi(pidfile); serr != nil {
+						err = passConfigPath(pidfile, c.String("config"))
+					}
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Couldn't pass on the config file to apiplexy at PID %d: %s\n", pid, err.Error())
+						os.Exit(1)
+					}
+				}
+				if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+					os.Remove(restartConfigFile(pidfile))
+					fmt.Fprintf(os.Stderr, "Couldn't signal apiplexy at PID %d: %s\n", pid, err.Error())
+					os.Exit(1)
+				}
+				fmt.Printf("Asked apiplexy at PID %d to restart gracefully.\n", pid)
+				return
+			}
+			fmt.Println("No running apiplexy to replace, starting a new one.")
+		} else if running && pid != syscall.Getppid() {
+			fmt.Fprintf(os.Stderr, "There is already a pidfile at '%s' that appears to belong to another apiplexy instance.\n", pidfile)
 			os.Exit(1)
 		}
 	}
 
-	if configPath == "" {
-		configPath = c.String("config")
-	}
-
 	ap, config, err := initApiplex(configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, err.Error())
 		os.Exit(1)
 	}
+	tlsConfig, err := apiplexy.BuildTLSConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't set up TLS. %s\n", err.Error())
+		os.Exit(1)
+	}
 
-	server := &http.Server{
-		Addr:           "0.0.0.0:" + strconv.Itoa(config.Serve.Port),
-		Handler:        ap,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 16,
+	// streamed downloads can take a while; write_timeout lets you raise the limit
+	// (or switch it off with a negative value)
+	writeTimeout := 10 * time.Second
+	if config.Serve.WriteTimeout > 0 {
+		writeTimeout = time.Duration(config.Serve.WriteTimeout) * time.Second
+	} else if config.Serve.WriteTimeout < 0 {
+		writeTimeout = 0
 	}
 
-	fmt.Printf("Launching apiplexy on port %d.\n", config.Serve.Port)
-	l, err := net.Listen("tcp", server.Addr)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't start server on %s: %s\n", server.Addr, err.Error())
-		os.Exit(1)
+	newServer := func(port int, handler http.Handler) *listener {
+		addr := "0.0.0.0:" + strconv.Itoa(port)
+		return &listener{addr: addr, server: &http.Server{
+			Addr:           addr,
+			Handler:        handler,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   writeTimeout,
+			MaxHeaderBytes: 1 << 16,
+		}}
+	}
+	plain := newServer(config.Serve.Port, ap)
+	listeners := []*listener{plain}
+	if tlsConfig != nil {
+		if config.Serve.TLS.Redirect {
+			plain.server.Handler = apiplexy.TLSRedirect(config)
+		}
+		secure := newServer(apiplexy.TLSPort(config), ap)
+		secure.server.TLSConfig = tlsConfig
+		if config.Serve.TLS.DisableHTTP2 {
+			secure.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+		listeners = append(listeners, secure)
+	}
+	if path := apiplexy.MetricsPath(config); path != "" && config.Serve.Metrics.Port > 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc(path, ap.Metrics)
+		listeners = append(listeners, newServer(config.Serve.Metrics.Port, mux))
+	}
+
+	for _, l := range listeners {
+		if il, ok := inherited[l.addr]; ok {
+			l.l = il
+			delete(inherited, l.addr)
+		} else if l.l, err = net.Listen("tcp", l.addr); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't start server on %s: %s\n", l.addr, err.Error())
+			os.Exit(1)
+		}
+	}
+	// sockets the new configuration doesn't use anymore
+	for _, il := range inherited {
+		il.Close()
+	}
+	if ready != nil {
+		fmt.Printf("Took over from the previous apiplexy on port %d.\n", config.Serve.Port)
+	} else {
+		fmt.Printf("Launching apiplexy on port %d.\n", config.Serve.Port)
+	}
+	if tlsConfig != nil {
+		fmt.Printf("Serving HTTPS on port %d.\n", apiplexy.TLSPort(config))
+	}
+	if path := apiplexy.MetricsPath(config); path != "" && config.Serve.Metrics.Port > 0 {
+		fmt.Printf("Serving metrics on port %d at %s.\n", config.Serve.Metrics.Port, path)
 	}
 
 	// write pidfile and wait for restart signal
@@ -176,7 +515,65 @@ func start(c *cli.Context) {
 		}
 	}()
 
-	server.Serve(l)
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			if l.server.TLSConfig != nil {
+				served <- l.server.ServeTLS(l.l, "", "")
+			} else {
+				served <- l.server.Serve(l.l)
+			}
+		}(l)
+	}
+	if ready != nil {
+		// tell the previous process we're up, so it can drain and exit
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		select {
+		case err := <-served:
+			fmt.Fprintf(os.Stderr, "Server stopped: %s\n", err.Error())
+			drain(listeners, ap, apiplexy.DrainTimeout(config))
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				newConfig, err := loadConfig(configPath)
+				if err == nil {
+					err = ap.Reload(newConfig)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Couldn't reload configuration, keeping the old one. %s\n", err.Error())
+					continue
+				}
+				config = newConfig
+				fmt.Printf("Reloaded configuration from %s.\n", configPath)
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				next := configPath
+				if pidfile != "" {
+					if path := takeConfigPath(pidfile); path != "" {
+						next = path
+					}
+				}
+				if err := spawnReplacement(listeners, next); err != nil {
+					fmt.Fprintf(os.Stderr, "Graceful restart failed, carrying on. %s\n", err.Error())
+					continue
+				}
+				fmt.Printf("Handed over to the new apiplexy, finishing requests in flight.\n")
+			} else {
+				fmt.Printf("Shutting down, finishing requests in flight.\n")
+				// a second signal means "now"
+				signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+			}
+			drain(listeners, ap, apiplexy.DrainTimeout(config))
+			return
+		}
+	}
 }
 
 func main() {
@@ -208,7 +605,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.BoolFlag{
 					Name:  "g",
-					Usage: "Restart gracefully, i.e. replace a previous apiplexy",
+					Usage: "Restart gracefully, i.e. replace a previous apiplexy without dropping connections (using the config file given, if any)",
 				},
 				cli.StringFlag{
 					Name:  "config, c",
@@ -234,6 +631,52 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:   "reload",
+			Usage:  "Makes a running apiplexy reload its config file",
+			Action: reload,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pidfile, p",
+					Value: "apiplexy.pid",
+					Usage: "Location of PID file (or the PID itself)",
+				},
+			},
+		},
+		{
+			Name:   "purge-cache",
+			Usage:  "Deletes cached responses (below a path, if one is given)",
+			Action: purgeCache,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Value: "apiplexy.yaml",
+					Usage: "Location of configuration file",
+				},
+			},
+		},
+		{
+			Name:   "rewrite",
+			Usage:  "Shows where a request would go and how it would be rewritten",
+			Action: traceRewrite,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Value: "apiplexy.yaml",
+					Usage: "Location of configuration file",
+				},
+				cli.StringFlag{
+					Name:  "method, X",
+					Value: "GET",
+					Usage: "Request method",
+				},
+				cli.StringSliceFlag{
+					Name:  "header, H",
+					Value: &cli.StringSlice{},
+					Usage: "Request header, as 'Name: value' (can be repeated)",
+				},
+			},
+		},
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,71 @@
+package apiplexy
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// Keys that were found by a backend are cached in redis for a while (auth_cache_ttl
+// seconds, 10 minutes by default), so not every request has to go to the backend.
+// Whenever a key changes or goes away, its cache entry has to go too.
+//
+// Revoked keys are refused before the cache is even looked at. That covers keys
+// that are deleted while a request is busy putting them back into the cache, as
+// well as leaked keys in backends apiplexy can't change.
+
+const revokedKeys = "revoked_keys"
+
+func authCacheKey(keyID string) string {
+	return "auth_cache:" + keyID
+}
+
+// drops keys from the auth cache, so their next request gets them fresh from
+// the backend
+func (ap *apiplex) invalidateKeys(rd redis.Conn, keyIDs ...string) error {
+	if len(keyIDs) == 0 {
+		return nil
+	}
+	names := make([]interface{}, len(keyIDs))
+	for i, id := range keyIDs {
+		names[i] = authCacheKey(id)
+	}
+	_, err := rd.Do("DEL", names...)
+	return err
+}
+
+// revokes a key for good (or until it's unrevoked)
+func (ap *apiplex) revokeKey(rd redis.Conn, keyID string) error {
+	if _, err := rd.Do("SADD", revokedKeys, keyID); err != nil {
+		return err
+	}
+	return ap.invalidateKeys(rd, keyID)
+}
+
+func (ap *apiplex) unrevokeKey(rd redis.Conn, keyID string) error {
+	_, err := rd.Do("SREM", revokedKeys, keyID)
+	return err
+}
+
+func (ap *apiplex) isRevoked(rd redis.Conn, keyID string) bool {
+	revoked, err := redis.Bool(rd.Do("SISMEMBER", revokedKeys, keyID))
+	if err != nil && err != redis.ErrNil {
+		ap.reportError(err)
+	}
+	return revoked
+}
+
+// drops all of a user's keys from the auth cache, e.g. after the user has been
+// suspended
+func (ap *apiplex) invalidateUserKeys(rd redis.Conn, email string) error {
+	if ap.usermgmt == nil {
+		return nil
+	}
+	keys, err := ap.usermgmt.GetAllKeys(email)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.ID
+	}
+	return ap.invalidateKeys(rd, ids...)
+}
@@ -0,0 +1,67 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func TestAuthCache(t *testing.T) {
+	keys := staticKeys{"k": &Key{ID: "k", Type: "Test", Quota: "default"}}
+	ap := &apiplex{authCacheTTL: 600, backends: []BackendPlugin{keys}}
+	chains := &pluginChains{auth: []AuthPlugin{&headerAuth{}}}
+	authenticate := func(rd memoryRedis) (*APIContext, error) {
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		req.Header.Set("Authorization", "k")
+		ctx := &APIContext{}
+		return ctx, ap.authenticateRequest(req, rd, ctx, chains)
+	}
+
+	Convey("Keys from a backend should be cached", t, func() {
+		rd := memoryRedis{}
+		_, err := authenticate(rd)
+		So(err, ShouldBeNil)
+		So(rd, ShouldContainKey, "auth_cache:k")
+	})
+
+	Convey("Invalidated keys should be fetched from the backend again", t, func() {
+		rd := memoryRedis{}
+		authenticate(rd)
+		keys["k"] = &Key{ID: "k", Type: "Test", Quota: "premium"}
+		ctx, _ := authenticate(rd)
+		So(ctx.Key.Quota, ShouldEqual, "default")
+
+		So(ap.invalidateKeys(rd, "k"), ShouldBeNil)
+		ctx, _ = authenticate(rd)
+		So(ctx.Key.Quota, ShouldEqual, "premium")
+	})
+
+	Convey("Revoked keys should be refused, even if they're still cached", t, func() {
+		rd := memoryRedis{}
+		authenticate(rd)
+		rd["revoked_keys|k"] = "1"
+		_, err := authenticate(rd)
+		So(err, ShouldNotBeNil)
+		So(err.(AbortRequest).Status, ShouldEqual, 403)
+
+		So(ap.unrevokeKey(rd, "k"), ShouldBeNil)
+		_, err = authenticate(rd)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Revoking a key should drop it from the cache", t, func() {
+		rd := memoryRedis{}
+		authenticate(rd)
+		So(ap.revokeKey(rd, "k"), ShouldBeNil)
+		So(rd, ShouldNotContainKey, "auth_cache:k")
+		So(ap.isRevoked(rd, "k"), ShouldBeTrue)
+	})
+
+	Convey("Nothing should be cached with a negative TTL", t, func() {
+		rd := memoryRedis{}
+		ap.authCacheTTL = -1
+		_, err := authenticate(rd)
+		So(err, ShouldBeNil)
+		So(rd, ShouldNotContainKey, "auth_cache:k")
+	})
+}
@@ -23,17 +23,19 @@ type sqlDBKey struct {
 	Data      string
 	Quota     string
 	User      string `sql:"not null;index"`
+	Suspended bool
 	CreatedAt time.Time
 	DeletedAt *time.Time
 }
 
 func (k *sqlDBKey) toKey() *apiplexy.Key {
 	ck := apiplexy.Key{
-		ID:    k.KeyID,
-		Realm: k.Realm,
-		Type:  k.Type,
-		Quota: k.Quota,
-		Owner: k.User,
+		ID:        k.KeyID,
+		Realm:     k.Realm,
+		Type:      k.Type,
+		Quota:     k.Quota,
+		Owner:     k.User,
+		Suspended: k.Suspended,
 	}
 	json.Unmarshal([]byte(k.Data), &ck.Data)
 	return &ck
@@ -64,6 +66,7 @@ func (u *sqlDBUser) toUser() *apiplexy.User {
 		Email:  u.Email,
 		Name:   u.Name,
 		Active: u.Active,
+		Admin:  u.Admin,
 	}
 	json.Unmarshal([]byte(u.Profile), &cu.Profile)
 	return &cu
@@ -73,11 +76,20 @@ type SQLDBBackend struct {
 	db gorm.DB
 }
 
+var _ apiplexy.AdminBackendPlugin = &SQLDBBackend{}
+
 func (sql *SQLDBBackend) GetKey(keyId string, keyType string) (*apiplexy.Key, error) {
 	k := sqlDBKey{}
 	if sql.db.Where(sqlDBKey{KeyID: keyId, Type: keyType}).First(&k).RecordNotFound() {
 		return nil, nil
 	}
+	// suspended keys, and keys of suspended users, don't work anymore
+	if k.Suspended {
+		return nil, nil
+	}
+	if sql.db.Where(&sqlDBUser{Email: k.User, Active: true}).First(&sqlDBUser{}).RecordNotFound() {
+		return nil, nil
+	}
 	return k.toKey(), nil
 }
 
@@ -203,6 +215,79 @@ func (sql *SQLDBBackend) GetAllKeys(email string) ([]*apiplexy.Key, error) {
 	return cks, nil
 }
 
+func (sql *SQLDBBackend) FindUsers(query string, offset, limit int) ([]*apiplexy.User, error) {
+	us := []sqlDBUser{}
+	q := sql.db.Order("email").Offset(offset).Limit(limit)
+	if query != "" {
+		like := "%" + query + "%"
+		q = q.Where("email LIKE ? OR name LIKE ?", like, like)
+	}
+	if err := q.Find(&us).Error; err != nil {
+		return nil, err
+	}
+	cus := make([]*apiplexy.User, len(us))
+	for i, u := range us {
+		cus[i] = u.toUser()
+	}
+	return cus, nil
+}
+
+func (sql *SQLDBBackend) SetUserActive(email string, active bool) error {
+	u := sqlDBUser{}
+	if sql.db.Where(&sqlDBUser{Email: email}).First(&u).RecordNotFound() {
+		return fmt.Errorf("User not found.")
+	}
+	// UpdateColumns would skip a false value
+	return sql.db.Model(&u).Where(&sqlDBUser{Email: email}).UpdateColumn("active", active).Error
+}
+
+func (sql *SQLDBBackend) DeleteUser(email string) error {
+	u := sqlDBUser{}
+	if sql.db.Where(&sqlDBUser{Email: email}).First(&u).RecordNotFound() {
+		return fmt.Errorf("User not found.")
+	}
+	if err := sql.db.Where(sqlDBKey{User: email}).Delete(sqlDBKey{}).Error; err != nil {
+		return err
+	}
+	return sql.db.Delete(&u).Error
+}
+
+func (sql *SQLDBBackend) FindKeys(query string, offset, limit int) ([]*apiplexy.Key, error) {
+	ks := []sqlDBKey{}
+	q := sql.db.Order("key_id").Offset(offset).Limit(limit)
+	if query != "" {
+		q = q.Where("key_id LIKE ?", "%"+query+"%").Or(sqlDBKey{User: query})
+	}
+	if err := q.Find(&ks).Error; err != nil {
+		return nil, err
+	}
+	cks := make([]*apiplexy.Key, len(ks))
+	for i, k := range ks {
+		cks[i] = k.toKey()
+	}
+	return cks, nil
+}
+
+func (sql *SQLDBBackend) GetKeyByID(keyID string) (*apiplexy.Key, error) {
+	k := sqlDBKey{}
+	if sql.db.Where(sqlDBKey{KeyID: keyID}).First(&k).RecordNotFound() {
+		return nil, nil
+	}
+	return k.toKey(), nil
+}
+
+func (sql *SQLDBBackend) UpdateKey(key *apiplexy.Key) error {
+	k := sqlDBKey{}
+	if sql.db.Where(sqlDBKey{KeyID: key.ID}).First(&k).RecordNotFound() {
+		return fmt.Errorf("Key does not exist.")
+	}
+	return sql.db.Model(&k).Where(sqlDBKey{KeyID: key.ID}).UpdateColumns(map[string]interface{}{
+		"realm":     key.Realm,
+		"quota":     key.Quota,
+		"suspended": key.Suspended,
+	}).Error
+}
+
 func (sql *SQLDBBackend) DefaultConfig() map[string]interface{} {
 	return map[string]interface{}{
 		"driver":            strings.Join(gosql.Drivers(), "/"),
@@ -233,7 +318,6 @@ func (sql *SQLDBBackend) Configure(config map[string]interface{}) error {
 }
 
 func init() {
-	// _ = apiplexy.ManagementBackendPlugin(&SQLDBBackend{})
 	apiplexy.RegisterPlugin(
 		"sql-full",
 		"Use popular SQL databases as backend stores (with full user/key management).",
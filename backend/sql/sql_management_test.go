@@ -170,3 +170,62 @@ func TestKeyManagement(t *testing.T) {
 	})
 
 }
+
+func TestAdministration(t *testing.T) {
+	admin := plugin.(apiplexy.AdminBackendPlugin)
+	admin.AddUser("admin-test@user.com", "password", &apiplexy.User{Name: "Someone Else"})
+	admin.ActivateUser("admin-test@user.com")
+	admin.AddKey("admin-test@user.com", &apiplexy.Key{ID: "adminkey", Type: "TestKey", Quota: "default"})
+
+	Convey("Users should be found by email or name", t, func() {
+		users, err := admin.FindUsers("someone", 0, 10)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 1)
+		So(users[0].Email, ShouldEqual, "admin-test@user.com")
+
+		users, err = admin.FindUsers("", 0, 1)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 1)
+	})
+
+	Convey("Keys should be found by ID or owner, with their owner filled in", t, func() {
+		keys, err := admin.FindKeys("admin-test@user.com", 0, 10)
+		So(err, ShouldBeNil)
+		So(len(keys), ShouldEqual, 1)
+		So(keys[0].Owner, ShouldEqual, "admin-test@user.com")
+
+		k, err := admin.GetKeyByID("adminkey")
+		So(err, ShouldBeNil)
+		So(k.Owner, ShouldEqual, "admin-test@user.com")
+	})
+
+	Convey("Suspended keys should stop working until they're reactivated", t, func() {
+		k, _ := admin.GetKeyByID("adminkey")
+		k.Suspended = true
+		So(admin.UpdateKey(k), ShouldBeNil)
+		found, _ := admin.GetKey("adminkey", "TestKey")
+		So(found, ShouldBeNil)
+
+		k.Suspended = false
+		k.Quota = "premium"
+		So(admin.UpdateKey(k), ShouldBeNil)
+		found, _ = admin.GetKey("adminkey", "TestKey")
+		So(found, ShouldNotBeNil)
+		So(found.Quota, ShouldEqual, "premium")
+	})
+
+	Convey("Keys of suspended users should stop working", t, func() {
+		So(admin.SetUserActive("admin-test@user.com", false), ShouldBeNil)
+		So(admin.GetUser("admin-test@user.com").Active, ShouldBeFalse)
+		found, _ := admin.GetKey("adminkey", "TestKey")
+		So(found, ShouldBeNil)
+		So(admin.SetUserActive("admin-test@user.com", true), ShouldBeNil)
+	})
+
+	Convey("Deleting a user should delete their keys", t, func() {
+		So(admin.DeleteUser("admin-test@user.com"), ShouldBeNil)
+		So(admin.GetUser("admin-test@user.com"), ShouldBeNil)
+		k, _ := admin.GetKeyByID("adminkey")
+		So(k, ShouldBeNil)
+	})
+}
@@ -0,0 +1,274 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies that can be set per API path.
+const (
+	strategyRandom     = "random"
+	strategyRoundRobin = "round-robin"
+	strategyLeastConn  = "least-conn"
+)
+
+// An upstreamPool holds all backends for one API path and decides which one
+// gets the next request. Backends that fail their health checks are skipped
+// until they recover.
+type upstreamPool struct {
+	path      string
+	strategy  string
+	upstreams []*APIUpstream
+	health    *apiplexConfigHealth
+	breaker   *apiplexConfigBreaker
+	websocket *apiplexConfigWebSocket
+	retry     *retryPolicy
+	cache     *responseCache
+	chains    *pluginChains
+	rewrites  []*rewriteRule
+	cors      *corsPolicy
+	compress  *compressor
+	errors    *errorRenderer
+	mutex     sync.Mutex
+}
+
+// Healthy reports whether the backend is currently in rotation.
+func (u *APIUpstream) Healthy() bool {
+	return atomic.LoadInt32(&u.down) == 0
+}
+
+// ActiveRequests returns the number of requests currently in flight to this backend.
+func (u *APIUpstream) ActiveRequests() int64 {
+	return atomic.LoadInt64(&u.active)
+}
+
+// can this backend take requests right now? (i.e. healthy and not cut off by its
+// circuit breaker)
+func (u *APIUpstream) available() bool {
+	return u.Healthy() && (u.breaker == nil || u.breaker.available())
+}
+
+func (u *APIUpstream) acquire() {
+	atomic.AddInt64(&u.active, 1)
+}
+
+func (u *APIUpstream) release() {
+	atomic.AddInt64(&u.active, -1)
+}
+
+// pick selects a healthy backend according to the pool's strategy. Returns nil
+// if no backend is healthy right now.
+func (p *upstreamPool) pick() *APIUpstream {
+	return p.pickExcept(nil)
+}
+
+// pickExcept works like pick, but never returns one of the skipped backends.
+func (p *upstreamPool) pickExcept(skip map[*APIUpstream]bool) *APIUpstream {
+	if len(p.upstreams) == 1 {
+		if p.upstreams[0].available() && !skip[p.upstreams[0]] {
+			return p.upstreams[0]
+		}
+		return nil
+	}
+
+	switch p.strategy {
+	case strategyRoundRobin:
+		return p.pickRoundRobin(skip)
+	case strategyLeastConn:
+		return p.pickLeastConn(skip)
+	default:
+		return p.pickRandom(skip)
+	}
+}
+
+// weighted random selection
+func (p *upstreamPool) pickRandom(skip map[*APIUpstream]bool) *APIUpstream {
+	total := 0
+	for _, u := range p.upstreams {
+		if u.available() && !skip[u] {
+			total += u.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, u := range p.upstreams {
+		if !u.available() || skip[u] {
+			continue
+		}
+		if n < u.Weight {
+			return u
+		}
+		n -= u.Weight
+	}
+	return nil
+}
+
+// smooth weighted round-robin, as done by nginx: every pick, each backend gains
+// its weight, the one with the highest score wins and pays back the total.
+func (p *upstreamPool) pickRoundRobin(skip map[*APIUpstream]bool) *APIUpstream {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var best *APIUpstream
+	total := 0
+	for _, u := range p.upstreams {
+		if !u.available() || skip[u] || u.Weight == 0 {
+			continue
+		}
+		u.rrScore += u.Weight
+		total += u.Weight
+		if best == nil || u.rrScore > best.rrScore {
+			best = u
+		}
+	}
+	if best != nil {
+		best.rrScore -= total
+	}
+	return best
+}
+
+// picks the backend with the fewest requests in flight relative to its weight
+func (p *upstreamPool) pickLeastConn(skip map[*APIUpstream]bool) *APIUpstream {
+	var best *APIUpstream
+	var bestLoad float64
+	for _, u := range p.upstreams {
+		if !u.available() || skip[u] || u.Weight == 0 {
+			continue
+		}
+		load := float64(u.ActiveRequests()) / float64(u.Weight)
+		if best == nil || load < bestLoad {
+			best = u
+			bestLoad = load
+		}
+	}
+	return best
+}
+
+// probes a single backend once and updates its health state. A backend has to
+// fail (or pass) several probes in a row before its state flips.
+func (ap *apiplex) probe(p *upstreamPool, u *APIUpstream) {
+	target := *u.Address
+	target.Path = u.Address.Path + p.health.Path
+	client := &http.Client{
+		Transport: u.Client.Transport,
+		Timeout:   time.Duration(p.health.Timeout) * time.Second,
+	}
+
+	var perr error
+	rs, err := client.Get(target.String())
+	if err != nil {
+		perr = err
+	} else {
+		io.Copy(ioutil.Discard, rs.Body)
+		rs.Body.Close()
+		if rs.StatusCode != p.health.Expect {
+			perr = fmt.Errorf("expected status %d, got %d", p.health.Expect, rs.StatusCode)
+		}
+	}
+
+	u.stateMutex.Lock()
+	defer u.stateMutex.Unlock()
+	u.lastCheck = time.Now()
+	if perr != nil {
+		u.lastError = perr.Error()
+		u.passes = 0
+		u.fails++
+		if u.Healthy() && u.fails >= p.health.UnhealthyThreshold {
+			atomic.StoreInt32(&u.down, 1)
+			ap.reportError(fmt.Errorf("Upstream backend %s for API path '%s' is unhealthy and has been taken out of rotation: %s", u.Address.String(), p.path, perr.Error()))
+		}
+	} else {
+		u.lastError = ""
+		u.fails = 0
+		u.passes++
+		if !u.Healthy() && u.passes >= p.health.HealthyThreshold {
+			atomic.StoreInt32(&u.down, 0)
+			log.Printf("Upstream backend %s for API path '%s' is healthy again.\n", u.Address.String(), p.path)
+		}
+	}
+}
+
+// runs active health checks for all pools that have them configured, until
+// the apiplex shuts down.
+func (ap *apiplex) startHealthChecks() {
+	ap.stopHealth = make(chan bool)
+	for _, p := range ap.upstreams {
+		if p.health == nil {
+			continue
+		}
+		go func(p *upstreamPool) {
+			ticker := time.NewTicker(time.Duration(p.health.Interval) * time.Second)
+			defer ticker.Stop()
+			for {
+				for _, u := range p.upstreams {
+					go ap.probe(p, u)
+				}
+				select {
+				case <-ticker.C:
+				case <-ap.stopHealth:
+					return
+				}
+			}
+		}(p)
+	}
+}
+
+type upstreamStatus struct {
+	Address   string     `json:"address"`
+	Weight    int        `json:"weight"`
+	Healthy   bool       `json:"healthy"`
+	Active    int64      `json:"active_requests"`
+	Breaker   string     `json:"breaker,omitempty"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+type poolStatus struct {
+	Strategy string           `json:"strategy"`
+	Checked  bool             `json:"health_checked"`
+	Backends []upstreamStatus `json:"backends"`
+}
+
+// UpstreamStatus serves the current health and load of all upstream backends
+// as JSON, keyed by API path.
+func (ap *apiplex) UpstreamStatus(res http.ResponseWriter, req *http.Request) {
+	status := make(map[string]poolStatus, len(ap.upstreams))
+	for path, p := range ap.upstreams {
+		ps := poolStatus{
+			Strategy: p.strategy,
+			Checked:  p.health != nil,
+			Backends: make([]upstreamStatus, len(p.upstreams)),
+		}
+		for i, u := range p.upstreams {
+			u.stateMutex.Lock()
+			us := upstreamStatus{
+				Address:   u.Address.String(),
+				Weight:    u.Weight,
+				Healthy:   u.Healthy(),
+				Active:    u.ActiveRequests(),
+				LastError: u.lastError,
+			}
+			if u.breaker != nil {
+				us.Breaker = u.breaker.State()
+			}
+			if !u.lastCheck.IsZero() {
+				lc := u.lastCheck
+				us.LastCheck = &lc
+			}
+			u.stateMutex.Unlock()
+			ps.Backends[i] = us
+		}
+		status[path] = ps
+	}
+	res.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(res).Encode(status)
+}
@@ -0,0 +1,120 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// a pool of backends a, b, c... with the given weights
+func testPool(strategy string, weights ...int) *upstreamPool {
+	p := &upstreamPool{path: "/test", strategy: strategy, upstreams: make([]*APIUpstream, len(weights))}
+	for i, w := range weights {
+		u, _ := url.Parse("http://" + string(rune('a'+i)))
+		p.upstreams[i] = &APIUpstream{Address: u, Weight: w}
+	}
+	return p
+}
+
+// picks n times and counts the picks per backend host
+func pickCounts(p *upstreamPool, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		if u := p.pick(); u != nil {
+			counts[u.Address.Host]++
+		} else {
+			counts[""]++
+		}
+	}
+	return counts
+}
+
+func TestBalancing(t *testing.T) {
+	Convey("Round-robin should spread picks smoothly by weight", t, func() {
+		p := testPool(strategyRoundRobin, 5, 1, 1)
+		picks := make([]string, 7)
+		for i := range picks {
+			picks[i] = p.pick().Address.Host
+		}
+		So(strings.Join(picks, ""), ShouldEqual, "aabacaa")
+	})
+
+	Convey("Each strategy should pick backends in proportion to their weights", t, func() {
+		for _, tc := range []struct {
+			strategy string
+			weights  []int
+			picks    int
+			want     map[string]int
+			slack    int
+		}{
+			{strategyRoundRobin, []int{1, 1, 1}, 300, map[string]int{"a": 100, "b": 100, "c": 100}, 0},
+			{strategyRoundRobin, []int{3, 1, 0}, 400, map[string]int{"a": 300, "b": 100}, 0},
+			{strategyRandom, []int{3, 1, 0}, 4000, map[string]int{"a": 3000, "b": 1000}, 200},
+			{strategyRandom, []int{1, 1}, 4000, map[string]int{"a": 2000, "b": 2000}, 200},
+		} {
+			counts := pickCounts(testPool(tc.strategy, tc.weights...), tc.picks)
+			So(len(counts), ShouldEqual, len(tc.want))
+			for host, want := range tc.want {
+				if tc.slack == 0 {
+					So(counts[host], ShouldEqual, want)
+				} else {
+					So(counts[host], ShouldBeBetweenOrEqual, want-tc.slack, want+tc.slack)
+				}
+			}
+		}
+	})
+
+	Convey("Least-conn should pick the backend with the fewest requests per weight", t, func() {
+		for _, tc := range []struct {
+			weights []int
+			active  []int64
+			want    string
+		}{
+			{[]int{1, 1, 1}, []int64{2, 0, 1}, "b"},
+			{[]int{4, 1}, []int64{4, 2}, "a"},
+			{[]int{1, 4}, []int64{1, 3}, "b"},
+			{[]int{1, 0}, []int64{5, 0}, "a"},
+		} {
+			p := testPool(strategyLeastConn, tc.weights...)
+			for i, n := range tc.active {
+				p.upstreams[i].active = n
+			}
+			So(p.pick().Address.Host, ShouldEqual, tc.want)
+		}
+	})
+
+	Convey("Unhealthy backends should be skipped by every strategy", t, func() {
+		for _, strategy := range []string{strategyRandom, strategyRoundRobin, strategyLeastConn} {
+			p := testPool(strategy, 5, 1, 1)
+			p.upstreams[0].down = 1
+			counts := pickCounts(p, 100)
+			So(counts["a"], ShouldEqual, 0)
+			So(counts[""], ShouldEqual, 0)
+			So(counts["b"]+counts["c"], ShouldEqual, 100)
+
+			p.upstreams[1].down = 1
+			p.upstreams[2].down = 1
+			So(p.pick(), ShouldBeNil)
+		}
+	})
+
+	Convey("Skipped backends should never be picked", t, func() {
+		for _, strategy := range []string{strategyRandom, strategyRoundRobin, strategyLeastConn} {
+			p := testPool(strategy, 1, 1)
+			skip := map[*APIUpstream]bool{p.upstreams[0]: true}
+			for i := 0; i < 20; i++ {
+				So(p.pickExcept(skip), ShouldEqual, p.upstreams[1])
+			}
+			skip[p.upstreams[1]] = true
+			So(p.pickExcept(skip), ShouldBeNil)
+		}
+	})
+
+	Convey("A single backend should be picked only while it's healthy", t, func() {
+		p := testPool(strategyRoundRobin, 1)
+		So(p.pick(), ShouldEqual, p.upstreams[0])
+		p.upstreams[0].down = 1
+		So(p.pick(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,190 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// A circuitBreaker watches the requests going to a single upstream backend.
+// Once the backend fails too often, the breaker opens and the backend gets no
+// more traffic. After a cooldown, the breaker lets a single request through
+// (half-open) to find out whether the backend has recovered.
+type circuitBreaker struct {
+	config      apiplexConfigBreaker
+	mutex       sync.Mutex
+	state       string
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	changedAt   time.Time
+	probing     bool
+}
+
+func newCircuitBreaker(config apiplexConfigBreaker) *circuitBreaker {
+	return &circuitBreaker{
+		config:      config,
+		state:       breakerClosed,
+		windowStart: time.Now(),
+		changedAt:   time.Now(),
+	}
+}
+
+func (cb *circuitBreaker) cooldown() time.Duration {
+	return time.Duration(cb.config.Cooldown) * time.Second
+}
+
+// State returns the breaker's current state.
+func (cb *circuitBreaker) State() string {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+// available is a cheap check whether the backend could take a request right now.
+// It doesn't change any state, so the balancer can call it freely.
+func (cb *circuitBreaker) available() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		return time.Since(cb.changedAt) >= cb.cooldown()
+	case breakerHalfOpen:
+		return !cb.probing || time.Since(cb.changedAt) >= cb.cooldown()
+	}
+	return true
+}
+
+// admit is called right before a request goes upstream. In half-open state,
+// only a single probe request is admitted at a time. Returns the previous state
+// if the state changed.
+func (cb *circuitBreaker) admit() (ok bool, from string) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.changedAt) < cb.cooldown() {
+			return false, ""
+		}
+		cb.state = breakerHalfOpen
+		cb.changedAt = time.Now()
+		cb.probing = true
+		return true, breakerOpen
+	case breakerHalfOpen:
+		// a probe that never came back shouldn't block the backend forever
+		if cb.probing && time.Since(cb.changedAt) < cb.cooldown() {
+			return false, ""
+		}
+		cb.changedAt = time.Now()
+		cb.probing = true
+	}
+	return true, ""
+}
+
+// record notes the outcome of an upstream request. Returns the previous state if
+// the state changed.
+func (cb *circuitBreaker) record(success bool) (from string) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.state == breakerHalfOpen {
+		cb.probing = false
+		if success {
+			cb.reset(breakerClosed)
+		} else {
+			cb.reset(breakerOpen)
+		}
+		return breakerHalfOpen
+	}
+	if cb.state == breakerOpen {
+		// stragglers that were already in flight when the breaker opened
+		return ""
+	}
+
+	if time.Since(cb.windowStart) > time.Duration(cb.config.Window)*time.Second {
+		cb.windowStart = time.Now()
+		cb.requests = 0
+		cb.failures = 0
+	}
+	cb.requests++
+	if success {
+		cb.consecutive = 0
+		return ""
+	}
+	cb.failures++
+	cb.consecutive++
+
+	trip := cb.config.Failures > 0 && cb.consecutive >= cb.config.Failures
+	if cb.config.ErrorRate > 0 && cb.requests >= cb.config.MinRequests {
+		trip = trip || float64(cb.failures)/float64(cb.requests) >= cb.config.ErrorRate
+	}
+	if trip {
+		cb.reset(breakerOpen)
+		return breakerClosed
+	}
+	return ""
+}
+
+func (cb *circuitBreaker) reset(state string) {
+	cb.state = state
+	cb.changedAt = time.Now()
+	cb.consecutive = 0
+	cb.requests = 0
+	cb.failures = 0
+	cb.windowStart = time.Now()
+}
+
+// Sends a breaker state change through the logging plugins, as a log entry of its
+// own. The request that caused the change goes along for context.
+func (ap *apiplex) logBreakerChange(req *http.Request, urs *http.Response, ctx *APIContext, from string) {
+	to := ctx.Upstream.breaker.State()
+	if to == breakerOpen {
+		ap.reportRequestError(fmt.Errorf("Circuit breaker for upstream backend %s (API path '%s') has opened. The backend gets no traffic until it recovers.", ctx.Upstream.Address.String(), ctx.APIPath), ctx)
+	}
+
+	status := 502
+	if urs != nil {
+		status = urs.StatusCode
+	}
+	ectx := *ctx
+	ectx.trace = nil
+	ectx.Log = map[string]interface{}{
+		"event":        "circuit_breaker",
+		"upstream":     ctx.Upstream.Address.String(),
+		"breaker_from": from,
+		"breaker_to":   to,
+		"status":       status,
+	}
+	ap.logRequest(req, urs, &ectx)
+}
+
+// Asks the upstream's circuit breaker (if any) whether a request may go through.
+func (ap *apiplex) admit(req *http.Request, ctx *APIContext) bool {
+	cb := ctx.Upstream.breaker
+	if cb == nil {
+		return true
+	}
+	ok, from := cb.admit()
+	if from != "" {
+		ap.logBreakerChange(req, nil, ctx, from)
+	}
+	return ok
+}
+
+// Tells the upstream's circuit breaker (if any) how a request went.
+func (ap *apiplex) recordOutcome(req *http.Request, urs *http.Response, ctx *APIContext, success bool) {
+	if cb := ctx.Upstream.breaker; cb != nil {
+		if from := cb.record(success); from != "" {
+			ap.logBreakerChange(req, urs, ctx, from)
+		}
+	}
+}
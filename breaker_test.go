@@ -0,0 +1,155 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// lets the breaker's cooldown run out
+func cooledDown(cb *circuitBreaker) {
+	cb.changedAt = cb.changedAt.Add(-cb.cooldown() - time.Second)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	Convey("The breaker should open after too many failures in a row", t, func() {
+		cb := newCircuitBreaker(apiplexConfigBreaker{Failures: 3, Window: 60, Cooldown: 30})
+		So(cb.record(false), ShouldEqual, "")
+		So(cb.record(false), ShouldEqual, "")
+		So(cb.record(true), ShouldEqual, "")
+		So(cb.record(false), ShouldEqual, "")
+		So(cb.record(false), ShouldEqual, "")
+		So(cb.State(), ShouldEqual, breakerClosed)
+		So(cb.record(false), ShouldEqual, breakerClosed)
+		So(cb.State(), ShouldEqual, breakerOpen)
+		So(cb.available(), ShouldBeFalse)
+	})
+
+	Convey("The breaker should open once the error rate is reached over enough requests", t, func() {
+		for _, tc := range []struct {
+			outcomes []bool
+			open     bool
+		}{
+			// too few requests to judge
+			{[]bool{false, false, false}, false},
+			{[]bool{true, false, true, false}, true},
+			{[]bool{true, true, true, false}, false},
+			{[]bool{true, true, true, false, false, false}, true},
+		} {
+			cb := newCircuitBreaker(apiplexConfigBreaker{ErrorRate: 0.5, MinRequests: 4, Window: 60, Cooldown: 30})
+			for _, ok := range tc.outcomes {
+				cb.record(ok)
+			}
+			So(cb.State() == breakerOpen, ShouldEqual, tc.open)
+		}
+	})
+
+	Convey("Failures from an earlier window shouldn't count", t, func() {
+		cb := newCircuitBreaker(apiplexConfigBreaker{ErrorRate: 0.5, MinRequests: 4, Window: 60, Cooldown: 30})
+		cb.record(false)
+		cb.record(false)
+		cb.record(true)
+		cb.windowStart = cb.windowStart.Add(-2 * time.Minute)
+		cb.record(false)
+		So(cb.requests, ShouldEqual, 1)
+		So(cb.State(), ShouldEqual, breakerClosed)
+	})
+
+	Convey("An open breaker should refuse requests until the cooldown is over", t, func() {
+		cb := newCircuitBreaker(apiplexConfigBreaker{Failures: 1, Window: 60, Cooldown: 30})
+		cb.record(false)
+		ok, from := cb.admit()
+		So(ok, ShouldBeFalse)
+		So(from, ShouldEqual, "")
+
+		cooledDown(cb)
+		So(cb.available(), ShouldBeTrue)
+		ok, from = cb.admit()
+		So(ok, ShouldBeTrue)
+		So(from, ShouldEqual, breakerOpen)
+		So(cb.State(), ShouldEqual, breakerHalfOpen)
+	})
+
+	Convey("A half-open breaker should let a single probe through", t, func() {
+		cb := newCircuitBreaker(apiplexConfigBreaker{Failures: 1, Window: 60, Cooldown: 30})
+		cb.record(false)
+		cooledDown(cb)
+		ok, _ := cb.admit()
+		So(ok, ShouldBeTrue)
+		So(cb.available(), ShouldBeFalse)
+		ok, _ = cb.admit()
+		So(ok, ShouldBeFalse)
+
+		// a probe that never comes back gets replaced after another cooldown
+		cooledDown(cb)
+		ok, _ = cb.admit()
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("A successful probe should close the breaker, a failed one open it again", t, func() {
+		for _, tc := range []struct {
+			success bool
+			state   string
+		}{
+			{true, breakerClosed},
+			{false, breakerOpen},
+		} {
+			cb := newCircuitBreaker(apiplexConfigBreaker{Failures: 1, Window: 60, Cooldown: 30})
+			cb.record(false)
+			cooledDown(cb)
+			cb.admit()
+			So(cb.record(tc.success), ShouldEqual, breakerHalfOpen)
+			So(cb.State(), ShouldEqual, tc.state)
+			So(cb.available(), ShouldEqual, tc.success)
+		}
+	})
+
+	Convey("Requests that finish after the breaker opened shouldn't change it", t, func() {
+		cb := newCircuitBreaker(apiplexConfigBreaker{Failures: 1, Window: 60, Cooldown: 30})
+		cb.record(false)
+		So(cb.record(true), ShouldEqual, "")
+		So(cb.State(), ShouldEqual, breakerOpen)
+	})
+}
+
+func TestBreakerFallback(t *testing.T) {
+	buildPool := func(breaker apiplexConfigBreaker) (*upstreamPool, error) {
+		ap := &apiplex{upstreams: make(map[string]*upstreamPool), chains: &pluginChains{}, plugins: newPluginSet()}
+		_, err := ap.buildRoutes("", map[string][]string{"/api": {"http://a"}},
+			map[string]apiplexConfigRoute{"/api": {Breaker: &breaker}}, nil, nil, map[string][]interface{}{})
+		return ap.upstreams["/api"], err
+	}
+
+	Convey("The configured fallback body should be served while the API is unavailable", t, func() {
+		pool, err := buildPool(apiplexConfigBreaker{Failures: 5, Body: "<down/>", ContentType: "application/xml"})
+		So(err, ShouldBeNil)
+		w := httptest.NewRecorder()
+		(&apiplex{}).unavailable(pool, w, &APIContext{})
+		So(w.Code, ShouldEqual, 503)
+		So(w.Header().Get("Content-Type"), ShouldEqual, "application/xml")
+		So(w.Body.String(), ShouldEqual, "<down/>")
+	})
+
+	Convey("Fallback bodies should be JSON unless a content type is given", t, func() {
+		pool, _ := buildPool(apiplexConfigBreaker{Failures: 5, Body: `{"down": true}`})
+		So(pool.breaker.ContentType, ShouldEqual, "application/json;charset=utf-8")
+		So(pool.upstreams[0].breaker, ShouldNotBeNil)
+	})
+
+	Convey("Without a fallback body the usual error should be served", t, func() {
+		pool, _ := buildPool(apiplexConfigBreaker{Failures: 5})
+		w := httptest.NewRecorder()
+		(&apiplex{}).unavailable(pool, w, &APIContext{})
+		So(w.Code, ShouldEqual, 503)
+		So(w.Header().Get("Content-Type"), ShouldEqual, "application/problem+json")
+		So(w.Body.String(), ShouldContainSubstring, `"code":"unavailable"`)
+	})
+
+	Convey("Breakers should need failures or an error rate between 0 and 1", t, func() {
+		_, err := buildPool(apiplexConfigBreaker{})
+		So(err, ShouldNotBeNil)
+		_, err = buildPool(apiplexConfigBreaker{ErrorRate: 1.5})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -1,16 +1,17 @@
 package apiplexy
 
 import (
+	"context"
 	"fmt"
 	"github.com/dchest/uniuri"
 	"github.com/garyburd/redigo/redis"
 	"gopkg.in/labstack/echo.v1"
-	"log"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -59,29 +60,52 @@ type apiplexPluginInfo struct {
 
 var registeredPlugins = make(map[string]apiplexPluginInfo)
 
+// An APIUpstream is a single backend server behind an API path. Weight is its
+// share of the traffic relative to the other backends on the same path.
 type APIUpstream struct {
 	Client  *http.Client
 	Address *url.URL
+	Weight  int
+
+	down    int32
+	active  int64
+	rrScore int
+	breaker *circuitBreaker
+
+	// health check bookkeeping
+	stateMutex sync.Mutex
+	fails      int
+	passes     int
+	lastCheck  time.Time
+	lastError  string
 }
 
 type apiplex struct {
-	signingKey    string
-	email         apiplexConfigEmail
-	lastAlert     *time.Time
-	upstreams     map[string][]APIUpstream
-	authCacheMins int
-	quotas        map[string]apiplexQuota
-	allowKeyless  bool
-	ewmaScript    *redis.Script
-	redis         *redis.Pool
-	auth          []AuthPlugin
-	backends      []BackendPlugin
-	usermgmt      ManagementBackendPlugin
-	postauth      []PostAuthPlugin
-	preupstream   []PreUpstreamPlugin
-	postupstream  []PostUpstreamPlugin
-	logging       []LoggingPlugin
-	startables    []LifecyclePlugin
+	signingKey      string
+	email           apiplexConfigEmail
+	lastAlert       *time.Time
+	upstreams       map[string]*upstreamPool
+	vhosts          map[string]*virtualHost
+	hostIndex       map[string]*virtualHost
+	hostPatterns    []string
+	clientIP        *clientIPResolver
+	stopHealth      chan bool
+	pendingLogs     sync.WaitGroup
+	inflight        sync.WaitGroup
+	retiring        bool
+	retireLock      sync.RWMutex
+	drainTimeout    time.Duration
+	requestIDHeader string
+	authCacheTTL    int
+	quotas          map[string]apiplexQuota
+	ewmaScript      *redis.Script
+	redis           *redis.Pool
+	chains          *pluginChains
+	backends        []BackendPlugin
+	usermgmt        ManagementBackendPlugin
+	plugins         *pluginSet
+	tracer          *tracer
+	errors          *errorRenderer
 }
 
 // RegisterPlugin makes your plugin available to apiplexy. You should probably
@@ -142,8 +166,9 @@ func ExampleConfiguration(pluginNames []string) (*ApiplexConfig, error) {
 			Static: map[string]string{
 				"/": "/path/to/your/portal_or_docs",
 			},
-			PortalAPI:  "/portal/",
-			SigningKey: uniuri.NewLen(64),
+			PortalAPI:      "/portal/",
+			SigningKey:     uniuri.NewLen(64),
+			TrustedProxies: []string{"127.0.0.1"},
 		},
 	}
 	plugins := apiplexConfigPlugins{}
@@ -198,39 +223,44 @@ func ensureDefaults(target map[string]interface{}, defaults map[string]interface
 
 // A little black magic here: buildPlugins uses reflection to reify and configure
 // actual working plugins from zero-value references. The plugins are also reflect-
-// typechecked so we don't run into nasty surprises later.
-func buildPlugins(plugins []apiplexPluginConfig, pluginType reflect.Type, startables []LifecyclePlugin) ([]interface{}, []LifecyclePlugin, error) {
-	built := make([]interface{}, len(plugins))
+// typechecked so we don't run into nasty surprises later. Plugins in reusable (left
+// over from a previous configuration) are taken as they are if their configuration
+// is unchanged.
+func buildPlugins(plugins []apiplexPluginConfig, pluginType reflect.Type, built *pluginSet, reusable map[string][]interface{}) ([]interface{}, error) {
+	chain := make([]interface{}, len(plugins))
 	for i, config := range plugins {
+		key := pluginKey(pluginType, config)
+		if prev := reusable[key]; len(prev) > 0 {
+			chain[i] = prev[0]
+			reusable[key] = prev[1:]
+			built.add(key, chain[i], false)
+			continue
+		}
+
 		ptype, ok := registeredPlugins[config.Plugin]
 		if !ok {
-			return nil, startables, fmt.Errorf("No plugin named '%s' available.", config.Plugin)
+			return nil, fmt.Errorf("No plugin named '%s' available.", config.Plugin)
 		}
 		pt := reflect.New(ptype.pluginType)
 
 		if !pt.Type().Implements(pluginType) {
-			return nil, startables, fmt.Errorf("Plugin '%s' (%s) cannot be loaded as %s.", config.Plugin, ptype.pluginType.Name(), pluginType.Name())
+			return nil, fmt.Errorf("Plugin '%s' (%s) cannot be loaded as %s.", config.Plugin, ptype.pluginType.Name(), pluginType.Name())
 		}
 
 		defConfig := pt.MethodByName("DefaultConfig").Call([]reflect.Value{})[0].Interface().(map[string]interface{})
 		if err := ensureDefaults(config.Config, defConfig); err != nil {
-			return nil, startables, fmt.Errorf("While configuring '%s': %s", config.Plugin, err.Error())
+			return nil, fmt.Errorf("While configuring '%s': %s", config.Plugin, err.Error())
 		}
 		maybeErr := pt.MethodByName("Configure").Call([]reflect.Value{reflect.ValueOf(config.Config)})[0].Interface()
 		if maybeErr != nil {
 			err := maybeErr.(error)
-			return nil, startables, fmt.Errorf("While configuring '%s': %s", config.Plugin, err.Error())
+			return nil, fmt.Errorf("While configuring '%s': %s", config.Plugin, err.Error())
 		}
 
-		st := pt.Interface()
-		built[i] = st
-
-		if pt.Type().Implements(reflect.TypeOf((*LifecyclePlugin)(nil)).Elem()) {
-			lt := st.(LifecyclePlugin)
-			startables = append(startables, lt)
-		}
+		chain[i] = pt.Interface()
+		built.add(key, chain[i], true)
 	}
-	return built, startables, nil
+	return chain, nil
 }
 
 // Helper method so all HTTP paths in the configuration have a final slash
@@ -240,60 +270,71 @@ func ensureSlashes(s string) string {
 }
 
 // constructs an Apiplex, i.e. an apiplexy struct that can run plugins on
-// requests and proxy them back to one or more upstream backends.
-func buildApiplex(config ApiplexConfig) (*apiplex, error) {
-	if len(config.Serve.Backends) == 0 {
-		return nil, fmt.Errorf("You haven't defined any API backends.")
-	}
-
-	for api, bes := range config.Serve.Backends {
-		if len(bes) == 0 {
-			return nil, fmt.Errorf("No backends specified for API path '%s'.", api)
-		}
-	}
-
+// requests and proxy them back to one or more upstream backends. When reloading,
+// previous is the apiplex that is being replaced; plugins are taken over from it
+// where possible.
+func buildApiplex(config ApiplexConfig, previous *apiplex) (*apiplex, error) {
 	if config.Serve.SigningKey == "" {
 		config.Serve.SigningKey = uniuri.NewLen(64)
 	}
 
 	// TODO make everything configurable
 	ap := apiplex{
-		authCacheMins: 10,
-		signingKey:    config.Serve.SigningKey,
-		email:         config.Email,
-		lastAlert:     nil,
+		authCacheTTL: 10 * 60,
+		signingKey:   config.Serve.SigningKey,
+		email:        config.Email,
+		lastAlert:    nil,
+		drainTimeout: DrainTimeout(config),
+	}
+	if config.Serve.AuthCacheTTL != 0 {
+		// negative switches the cache off
+		ap.authCacheTTL = config.Serve.AuthCacheTTL
+	}
+	ap.requestIDHeader = requestIDHeader(config.Serve.RequestIDHeader)
+
+	errors, err := newErrorRenderer(config.Serve.Errors)
+	if err != nil {
+		return nil, err
 	}
+	ap.errors = errors
+
+	clientIP, err := newClientIPResolver(config.Serve.TrustedProxies, config.Serve.ClientIPHeaders)
+	if err != nil {
+		return nil, err
+	}
+	ap.clientIP = clientIP
 
 	if _, ok := config.Quotas["default"]; !ok {
 		return nil, fmt.Errorf("Your configuration must specify at least a 'default' quota.")
 	}
+	allowKeyless := false
 	if kl, ok := config.Quotas["keyless"]; ok {
 		if kl.MaxKey != 0 {
 			return nil, fmt.Errorf("You cannot set a per-key maximum for the 'keyless' quota.")
 		}
-		ap.allowKeyless = true
-	} else {
-		ap.allowKeyless = false
+		allowKeyless = true
 	}
 	ap.quotas = config.Quotas
 
-	// this slice will contain all plugins that implement LifecyclePlugin after all plugins
-	// are configured
-	startables := []LifecyclePlugin{}
+	// this will contain all plugins (and the ones that implement LifecyclePlugin) after
+	// all plugins are configured
+	ap.plugins = newPluginSet()
+	reusable := make(map[string][]interface{})
+	if previous != nil {
+		for key, plugins := range previous.plugins.configured {
+			reusable[key] = plugins
+		}
+	}
 
-	// auth plugins
-	auth, startables, err := buildPlugins(config.Plugins.Auth, reflect.TypeOf((*AuthPlugin)(nil)).Elem(), startables)
+	// request plugins (auth, postauth, preupstream, postupstream and logging)
+	ap.chains, err = buildChains(config.Plugins.chains(), ap.plugins, reusable)
 	if err != nil {
 		return nil, err
 	}
-	ap.auth = make([]AuthPlugin, len(auth))
-	for i, p := range auth {
-		cp := p.(AuthPlugin)
-		ap.auth[i] = cp
-	}
+	ap.chains.keyless = allowKeyless
 
 	// backend plugins
-	backend, startables, err := buildPlugins(config.Plugins.Backend, reflect.TypeOf((*BackendPlugin)(nil)).Elem(), startables)
+	backend, err := buildPlugins(config.Plugins.Backend, reflect.TypeOf((*BackendPlugin)(nil)).Elem(), ap.plugins, reusable)
 	if err != nil {
 		return nil, err
 	}
@@ -316,66 +357,10 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 		}
 	}
 
-	// postauth plugins
-	postauth, startables, err := buildPlugins(config.Plugins.PostAuth, reflect.TypeOf((*PostAuthPlugin)(nil)).Elem(), startables)
-	if err != nil {
-		return nil, err
-	}
-	ap.postauth = make([]PostAuthPlugin, len(postauth))
-	for i, p := range postauth {
-		cp := p.(PostAuthPlugin)
-		ap.postauth[i] = cp
-	}
-
-	// preupstream plugins
-	preupstream, startables, err := buildPlugins(config.Plugins.PreUpstream, reflect.TypeOf((*PreUpstreamPlugin)(nil)).Elem(), startables)
-	if err != nil {
-		return nil, err
-	}
-	ap.preupstream = make([]PreUpstreamPlugin, len(preupstream))
-	for i, p := range preupstream {
-		cp := p.(PreUpstreamPlugin)
-		ap.preupstream[i] = cp
-	}
-
-	// postupstream plugins
-	postupstream, startables, err := buildPlugins(config.Plugins.PostUpstream, reflect.TypeOf((*PostUpstreamPlugin)(nil)).Elem(), startables)
-	if err != nil {
-		return nil, err
-	}
-	ap.postupstream = make([]PostUpstreamPlugin, len(postupstream))
-	for i, p := range postupstream {
-		cp := p.(PostUpstreamPlugin)
-		ap.postupstream[i] = cp
-	}
-
-	// logging plugins
-	logging, startables, err := buildPlugins(config.Plugins.Logging, reflect.TypeOf((*LoggingPlugin)(nil)).Elem(), startables)
-	if err != nil {
+	// upstream backends, for the default host and all virtual hosts
+	if err := ap.buildVirtualHosts(config, reusable); err != nil {
 		return nil, err
 	}
-	ap.logging = make([]LoggingPlugin, len(logging))
-	for i, p := range logging {
-		cp := p.(LoggingPlugin)
-		ap.logging[i] = cp
-	}
-
-	// upstream backends
-	ap.upstreams = make(map[string][]APIUpstream, len(config.Serve.Backends))
-	for api, bes := range config.Serve.Backends {
-		ups := make([]APIUpstream, len(bes))
-		for i, up := range bes {
-			u, err := url.Parse(up)
-			if err != nil {
-				return nil, fmt.Errorf("Invalid upstream address: %s", up)
-			}
-			ups[i] = APIUpstream{
-				Client:  &http.Client{},
-				Address: u,
-			}
-		}
-		ap.upstreams[api] = ups
-	}
 
 	ap.redis = &redis.Pool{
 		MaxIdle:     3,
@@ -398,42 +383,229 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 	rd := ap.redis.Get()
 	ap.ewmaScript = redis.NewScript(2, ewmaScript)
 	err = ap.ewmaScript.Load(rd)
+	rd.Close()
 	if err != nil {
-		log.Fatalf("Couldn't connect to Redis. %s", err.Error())
+		ap.redis.Close()
+		return nil, fmt.Errorf("Couldn't connect to Redis. %s", err.Error())
+	}
+
+	if config.Tracing != nil {
+		if ap.tracer, err = newTracer(*config.Tracing); err != nil {
+			ap.redis.Close()
+			return nil, err
+		}
 	}
 
-	ap.startables = startables
-	for _, st := range ap.startables {
+	// only plugins that weren't taken over need starting
+	for i, st := range ap.plugins.fresh {
 		err := st.Start(ap.reportError)
 		if err != nil {
-			log.Fatalf("Error starting plugin. %s", err.Error())
+			for _, started := range ap.plugins.fresh[:i] {
+				started.Stop()
+			}
+			if ap.tracer != nil {
+				ap.tracer.exporter.shutdown()
+			}
+			ap.redis.Close()
+			return nil, fmt.Errorf("Error starting plugin. %s", err.Error())
 		}
 	}
 
+	ap.startHealthChecks()
+
 	return &ap, nil
 }
 
-func (ap *apiplex) Shutdown() {
-	for _, st := range ap.startables {
-		err := st.Stop()
+// Builds the backend pools and the router for the API paths of one (virtual) host.
+func (ap *apiplex) buildRoutes(vhost string, backends map[string][]string, routeConfig map[string]apiplexConfigRoute, cors *apiplexConfigCORS, compression *apiplexConfigCompression, reusable map[string][]interface{}) (*router, error) {
+	routes := make([]*apiRoute, 0, len(backends))
+	for api, bes := range backends {
+		if len(bes) == 0 {
+			return nil, fmt.Errorf("No backends specified for API path '%s'.", api)
+		}
+		route := routeConfig[api]
+		pool := &upstreamPool{
+			path:      api,
+			strategy:  route.Strategy,
+			upstreams: make([]*APIUpstream, len(bes)),
+		}
+		switch pool.strategy {
+		case "":
+			pool.strategy = strategyRandom
+		case strategyRandom, strategyRoundRobin, strategyLeastConn:
+		default:
+			return nil, fmt.Errorf("Unknown load balancing strategy '%s' for API path '%s'. Use %s, %s or %s.", route.Strategy, api, strategyRandom, strategyRoundRobin, strategyLeastConn)
+		}
+		for addr := range route.Weights {
+			known := false
+			for _, up := range bes {
+				known = known || up == addr
+			}
+			if !known {
+				return nil, fmt.Errorf("Weight given for '%s', which is not a backend of API path '%s'.", addr, api)
+			}
+		}
+		client, err := buildClient(api, route.Transport)
 		if err != nil {
-			log.Printf("Error stopping plugin. %s\n", err.Error())
+			return nil, err
+		}
+		for i, up := range bes {
+			u, err := url.Parse(up)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid upstream address: %s", up)
+			}
+			weight, ok := route.Weights[up]
+			if !ok {
+				weight = 1
+			} else if weight < 0 {
+				return nil, fmt.Errorf("Backend '%s' has a negative weight.", up)
+			}
+			pool.upstreams[i] = &APIUpstream{
+				Client:  client,
+				Address: u,
+				Weight:  weight,
+			}
+		}
+		if route.Health != nil {
+			h := *route.Health
+			if h.Interval <= 0 {
+				h.Interval = 10
+			}
+			if h.Timeout <= 0 {
+				h.Timeout = 5
+			}
+			if h.Expect == 0 {
+				h.Expect = 200
+			}
+			if h.HealthyThreshold <= 0 {
+				h.HealthyThreshold = 2
+			}
+			if h.UnhealthyThreshold <= 0 {
+				h.UnhealthyThreshold = 2
+			}
+			pool.health = &h
+		}
+		if route.Breaker != nil {
+			b := *route.Breaker
+			if b.Failures <= 0 && b.ErrorRate <= 0 {
+				return nil, fmt.Errorf("Circuit breaker for API path '%s' needs a number of failures, an error rate, or both.", api)
+			}
+			if b.ErrorRate > 1 {
+				return nil, fmt.Errorf("Circuit breaker error rate for API path '%s' must be between 0 and 1.", api)
+			}
+			if b.MinRequests <= 0 {
+				b.MinRequests = 10
+			}
+			if b.Window <= 0 {
+				b.Window = 60
+			}
+			if b.Cooldown <= 0 {
+				b.Cooldown = 30
+			}
+			if b.Body != "" && b.ContentType == "" {
+				b.ContentType = "application/json;charset=utf-8"
+			}
+			pool.breaker = &b
+			for _, u := range pool.upstreams {
+				u.breaker = newCircuitBreaker(b)
+			}
+		}
+		if route.Retry != nil {
+			rp, err := newRetryPolicy(api, *route.Retry)
+			if err != nil {
+				return nil, err
+			}
+			pool.retry = rp
+		}
+		if route.WebSocket != nil {
+			ws := *route.WebSocket
+			pool.websocket = &ws
+		}
+		if route.Cache != nil {
+			pool.cache = newResponseCache(*route.Cache)
+		}
+		pool.rewrites, err = newRewriteRules(api, route.Rewrite)
+		if err != nil {
+			return nil, err
+		}
+		if c := route.Compression; c != nil || compression != nil {
+			if c == nil {
+				c = compression
+			}
+			if pool.compress, err = newCompressor(*c); err != nil {
+				return nil, fmt.Errorf("In compression for API path '%s': %s", api, err.Error())
+			}
+		}
+		if c := route.CORS; c != nil || cors != nil {
+			if c == nil {
+				c = cors
+			}
+			if pool.cors, err = newCORSPolicy(api, *c, route.Methods); err != nil {
+				return nil, err
+			}
+		}
+		if pool.errors, err = ap.errors.extend(route.Errors); err != nil {
+			return nil, fmt.Errorf("In errors for API path '%s': %s", api, err.Error())
+		}
+		pool.chains, err = buildRouteChains(api, ap.chains, route, ap.plugins, reusable)
+		if err != nil {
+			return nil, err
+		}
+		ap.upstreams[routeKey(vhost, api)] = pool
+		routes = append(routes, newRoute(api, route, pool))
+	}
+	for api := range routeConfig {
+		if _, ok := backends[api]; !ok {
+			return nil, fmt.Errorf("Route settings given for '%s', but there are no backends for that API path.", api)
 		}
 	}
+	return newRouter(routes), nil
 }
 
-func New(config ApiplexConfig) (http.Handler, error) {
-	ap, err := buildApiplex(config)
-	if err != nil {
-		return nil, err
+// DrainTimeout is how long a shutdown waits, all told, for requests in flight
+// and their logging before giving up on them. Defaults to 30 seconds.
+func DrainTimeout(config ApiplexConfig) time.Duration {
+	if config.Serve.DrainTimeout > 0 {
+		return time.Duration(config.Serve.DrainTimeout) * time.Second
 	}
+	return 30 * time.Second
+}
+
+func (ap *apiplex) Shutdown(ctx context.Context) {
+	ap.retire(ctx, nil)
+}
 
+// A Gateway is the API proxy built by New. Reload swaps in a new configuration
+// while requests keep coming in; if the new configuration doesn't work out, the
+// old one stays in place. Once the gateway no longer receives requests, Shutdown
+// stops the health checks and all LifecyclePlugins, so they can flush whatever
+// they have buffered. It waits for requests and logging until ctx is done.
+type Gateway interface {
+	http.Handler
+	Reload(config ApiplexConfig) error
+	Shutdown(ctx context.Context)
+	Metrics(res http.ResponseWriter, req *http.Request)
+}
+
+// MetricsPath is where metrics are served, or "" if they're switched off.
+func MetricsPath(config ApiplexConfig) string {
+	if config.Serve.Metrics == nil {
+		return ""
+	}
+	if config.Serve.Metrics.Path == "" {
+		return "/metrics"
+	}
+	return ensureSlashes(config.Serve.Metrics.Path)
+}
+
+// builds the request router for a (virtual) host of an apiplex
+func buildMux(ap *apiplex, vh *virtualHost, config ApiplexConfig) (*echo.Echo, error) {
 	mux := echo.New()
 	mux.SetDebug(true)
-	for static, path := range config.Serve.Static {
+	for static, path := range vh.config.Static {
 		mux.Static(static, path)
 	}
-	for api, _ := range config.Serve.Backends {
+	for api, _ := range vh.config.Backends {
 		// double-check this since if someone puts an API backend on / it becomes //
 		rpath := ensureSlashes(api)
 		if rpath == "/" {
@@ -441,13 +613,34 @@ func New(config ApiplexConfig) (http.Handler, error) {
 		}
 		mux.Any(rpath+"/*", ap.HandleAPI)
 	}
-	if config.Serve.PortalAPI != "" {
-		papath := ensureSlashes(config.Serve.PortalAPI)
+	if config.Serve.StatusAPI != "" {
+		mux.Get(ensureSlashes(config.Serve.StatusAPI), ap.UpstreamStatus)
+	}
+	// metrics on their own port are served by the CLI's admin listener
+	if path := MetricsPath(config); path != "" && config.Serve.Metrics.Port == 0 {
+		mux.Get(path, ap.Metrics)
+	}
+	if vh.config.PortalAPI != "" {
+		papath := ensureSlashes(vh.config.PortalAPI)
 		_, err := ap.BuildPortalAPI(mux, papath)
 		if err != nil {
 			return nil, fmt.Errorf("Could not create Portal API. %s", err.Error())
 		}
 	}
+	if vh.config.AdminAPI != "" {
+		_, err := ap.BuildAdminAPI(mux, ensureSlashes(vh.config.AdminAPI))
+		if err != nil {
+			return nil, fmt.Errorf("Could not create admin API. %s", err.Error())
+		}
+	}
 
 	return mux, nil
 }
+
+func New(config ApiplexConfig) (Gateway, error) {
+	g := &gateway{}
+	if err := g.Reload(config); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
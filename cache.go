@@ -0,0 +1,326 @@
+package apiplexy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Only responses with these statuses are ever cached.
+var cacheableStatuses = map[int]bool{200: true, 203: true, 301: true, 404: true, 410: true}
+
+// Headers that only belong to one response: hop-by-hop headers, cookies, and the
+// ones the gateway sets on every response by itself.
+var unstoredHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade", "Set-Cookie", "Date", "Age", "Content-Length",
+	"X-Cache", "X-Auth-Type",
+}
+
+// Headers that describe the body. Plugins may have changed the body, so these are
+// taken from the response as it went out.
+var bodyHeaders = []string{"Content-Type", "Content-Encoding", "Content-Language"}
+
+// A responseCache stores upstream responses of one API path in Redis, so repeated
+// GET requests don't have to go upstream. Entries live under cache:<path>?<query>
+// (followed by the virtual host), which makes it easy to purge everything below
+// some path.
+type responseCache struct {
+	ttl     time.Duration
+	perKey  bool
+	maxSize int
+}
+
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Stored int64       `json:"stored"`
+}
+
+func newResponseCache(config apiplexConfigCache) *responseCache {
+	c := &responseCache{
+		ttl:     time.Duration(config.TTL) * time.Second,
+		perKey:  config.PerKey,
+		maxSize: config.MaxSize,
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = 1024 * 1024
+	}
+	return c
+}
+
+// parses a Cache-Control header into its directives
+func cacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if kv[0] == "" {
+				continue
+			}
+			if len(kv) == 2 {
+				cc[strings.ToLower(kv[0])] = strings.Trim(kv[1], "\"")
+			} else {
+				cc[strings.ToLower(kv[0])] = ""
+			}
+		}
+	}
+	return cc
+}
+
+// cache key for a request, without the Vary part
+func (c *responseCache) baseKey(req *http.Request, ctx *APIContext) string {
+	k := "cache:" + req.URL.Path + "?" + req.URL.RawQuery + "|" + ctx.VHost + "|"
+	if c.perKey && ctx.Key != nil {
+		k = k + ctx.Key.ID
+	}
+	return k
+}
+
+// hashes the request's values for the headers named in a Vary header
+func varyHash(req *http.Request, vary string) string {
+	names := strings.Split(vary, ",")
+	for i, n := range names {
+		names[i] = http.CanonicalHeaderKey(strings.TrimSpace(n))
+	}
+	sort.Strings(names)
+	h := sha1.New()
+	for _, n := range names {
+		fmt.Fprintf(h, "%s:%s\n", n, strings.Join(req.Header[n], ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// can this request be answered from the cache at all?
+func (c *responseCache) lookupAllowed(req *http.Request) bool {
+	if req.Method != "GET" || isUpgrade(req) {
+		return false
+	}
+	cc := cacheControl(req.Header)
+	_, noCache := cc["no-cache"]
+	_, noStore := cc["no-store"]
+	return !noCache && !noStore && req.Header.Get("Pragma") != "no-cache"
+}
+
+func (c *responseCache) lookup(rd redis.Conn, req *http.Request, ctx *APIContext) *cachedResponse {
+	base := c.baseKey(req, ctx)
+	vary, _ := redis.String(rd.Do("GET", base+"|vary"))
+	raw, err := redis.Bytes(rd.Do("GET", base+"|"+varyHash(req, vary)))
+	if err != nil {
+		return nil
+	}
+	entry := cachedResponse{}
+	if json.Unmarshal(raw, &entry) != nil {
+		return nil
+	}
+	return &entry
+}
+
+// Works out whether (and for how long) an upstream response may be cached, going by
+// the headers the backend sent (Cache-Control and Expires), unless the route sets a
+// fixed TTL. Responses marked private are only ever cached per key, and only for
+// requests that have one.
+func (c *responseCache) storable(req *http.Request, ctx *APIContext, status int, h http.Header) (time.Duration, bool) {
+	if req.Method != "GET" || !cacheableStatuses[status] {
+		return 0, false
+	}
+	if _, noStore := cacheControl(req.Header)["no-store"]; noStore {
+		return 0, false
+	}
+	if strings.TrimSpace(h.Get("Vary")) == "*" || h.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok && (!c.perKey || ctx.Key == nil) {
+		return 0, false
+	}
+
+	if c.ttl > 0 {
+		return c.ttl, true
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0, false
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		expires, err := http.ParseTime(exp)
+		if err != nil {
+			return 0, false
+		}
+		now := time.Now()
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			now = date
+		}
+		if ttl := expires.Sub(now); ttl >= time.Second {
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// Builds the headers of a cache entry from the headers the backend sent and the
+// ones that went out with the response, leaving out everything that belongs to
+// this response only (including the names given in drop).
+func entryHeader(upstream, final http.Header, drop ...string) http.Header {
+	h := make(http.Header, len(upstream))
+	for k, vv := range upstream {
+		h[k] = vv
+	}
+	for _, name := range bodyHeaders {
+		if vv, ok := final[name]; ok {
+			h[name] = vv
+		} else {
+			delete(h, name)
+		}
+	}
+	// headers named in Connection are hop-by-hop as well
+	for _, v := range upstream["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range append(unstoredHeaders, drop...) {
+		h.Del(name)
+	}
+	return h
+}
+
+func (c *responseCache) store(rd redis.Conn, req *http.Request, ctx *APIContext, status int, header http.Header, body []byte, ttl time.Duration) error {
+	entry := cachedResponse{
+		Status: status,
+		Header: header,
+		Body:   body,
+		Stored: time.Now().Unix(),
+	}
+	raw, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	secs := int(ttl / time.Second)
+	base := c.baseKey(req, ctx)
+	vary := header.Get("Vary")
+	if vary != "" {
+		rd.Send("SETEX", base+"|vary", secs, vary)
+	} else {
+		rd.Send("DEL", base+"|vary")
+	}
+	rd.Send("SETEX", base+"|"+varyHash(req, vary), secs, raw)
+	_, err = rd.Do("")
+	return err
+}
+
+// collects a streamed response body for the cache, up to a size limit
+type cacheCapture struct {
+	max      int
+	buf      []byte
+	overflow bool
+}
+
+func (cc *cacheCapture) Write(p []byte) (int, error) {
+	if !cc.overflow {
+		if len(cc.buf)+len(p) > cc.max {
+			cc.overflow = true
+			cc.buf = nil
+		} else {
+			cc.buf = append(cc.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// Answers a request from a cache entry.
+func (ap *apiplex) serveCached(res http.ResponseWriter, req *http.Request, ctx *APIContext, entry *cachedResponse, requestStart time.Time) {
+	for k, vv := range entry.Header {
+		for _, v := range vv {
+			res.Header().Add(k, v)
+		}
+	}
+	res.Header().Set("Age", strconv.FormatInt(time.Now().Unix()-entry.Stored, 10))
+	res.Header().Set("X-Cache", "HIT")
+	if ctx.Key == nil {
+		res.Header().Set("X-Auth-Type", "No Key")
+	} else {
+		res.Header().Set("X-Auth-Type", ctx.Key.Type)
+	}
+	res.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	res.WriteHeader(entry.Status)
+	res.Write(entry.Body)
+
+	if !ctx.DoNotLog {
+		ctx.Log["status"] = entry.Status
+		ctx.Log["cache"] = "HIT"
+		ctx.Log["bytes"] = int64(len(entry.Body))
+		ctx.Log["time_total"] = time.Since(requestStart).Nanoseconds()
+		urs := &http.Response{
+			Status:     strconv.Itoa(entry.Status) + " " + http.StatusText(entry.Status),
+			StatusCode: entry.Status,
+			Header:     entry.Header,
+			Request:    req,
+		}
+		ap.logRequest(req, urs, ctx)
+	}
+}
+
+// escapes glob characters for a Redis MATCH pattern
+func escapeGlob(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return r.Replace(s)
+}
+
+// PurgeCache deletes all cached responses for paths starting with the given
+// prefix (all of them, if the prefix is empty). Returns the number of deleted
+// cache entries.
+func PurgeCache(config ApiplexConfig, prefix string) (int, error) {
+	rd, err := redis.Dial("tcp", config.Redis.Host+":"+strconv.Itoa(config.Redis.Port))
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't connect to Redis. %s", err.Error())
+	}
+	defer rd.Close()
+	if _, err := rd.Do("SELECT", config.Redis.DB); err != nil {
+		return 0, err
+	}
+
+	pattern := "cache:" + escapeGlob(prefix) + "*"
+	cursor := 0
+	deleted := 0
+	for {
+		reply, err := redis.Values(rd.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return deleted, err
+		}
+		cursor, _ = redis.Int(reply[0], nil)
+		keys, _ := redis.Values(reply[1], nil)
+		if len(keys) > 0 {
+			if _, err := rd.Do("DEL", keys...); err != nil {
+				return deleted, err
+			}
+			for _, k := range keys {
+				if s, _ := redis.String(k, nil); !strings.HasSuffix(s, "|vary") {
+					deleted++
+				}
+			}
+		}
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
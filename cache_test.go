@@ -0,0 +1,117 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func cacheHeader(headers map[string]string) http.Header {
+	h := http.Header{}
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+	return h
+}
+
+func TestResponseCache(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://gateway/x?a=1", nil)
+	c := newResponseCache(apiplexConfigCache{})
+	ctx := &APIContext{Key: &Key{ID: "k1"}}
+
+	Convey("Cache-Control max-age should set the TTL", t, func() {
+		ttl, ok := c.storable(req, ctx, 200, cacheHeader(map[string]string{"Cache-Control": "public, max-age=60"}))
+		So(ok, ShouldBeTrue)
+		So(ttl, ShouldEqual, 60*time.Second)
+	})
+
+	Convey("s-maxage should win over max-age", t, func() {
+		ttl, _ := c.storable(req, ctx, 200, cacheHeader(map[string]string{"Cache-Control": "max-age=60, s-maxage=10"}))
+		So(ttl, ShouldEqual, 10*time.Second)
+	})
+
+	Convey("Expires should be measured against the response's Date", t, func() {
+		now := time.Now().UTC()
+		ttl, ok := c.storable(req, ctx, 200, cacheHeader(map[string]string{
+			"Date":    now.Format(http.TimeFormat),
+			"Expires": now.Add(2 * time.Minute).Format(http.TimeFormat),
+		}))
+		So(ok, ShouldBeTrue)
+		So(ttl, ShouldEqual, 2*time.Minute)
+	})
+
+	Convey("Uncacheable responses should not be stored", t, func() {
+		for _, h := range []map[string]string{
+			{"Cache-Control": "no-store"},
+			{"Cache-Control": "private, max-age=60"},
+			{"Cache-Control": "max-age=60", "Vary": "*"},
+			{"Cache-Control": "max-age=60", "Set-Cookie": "a=b"},
+			{},
+		} {
+			_, ok := c.storable(req, ctx, 200, cacheHeader(h))
+			So(ok, ShouldBeFalse)
+		}
+		_, ok := c.storable(req, ctx, 500, cacheHeader(map[string]string{"Cache-Control": "max-age=60"}))
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("A route TTL should override the headers", t, func() {
+		fixed := newResponseCache(apiplexConfigCache{TTL: 5, PerKey: true})
+		ttl, ok := fixed.storable(req, ctx, 200, cacheHeader(map[string]string{"Cache-Control": "private"}))
+		So(ok, ShouldBeTrue)
+		So(ttl, ShouldEqual, 5*time.Second)
+	})
+
+	Convey("A route TTL shouldn't override private or no-store", t, func() {
+		shared := newResponseCache(apiplexConfigCache{TTL: 5})
+		_, ok := shared.storable(req, ctx, 200, cacheHeader(map[string]string{"Cache-Control": "private"}))
+		So(ok, ShouldBeFalse)
+		perKey := newResponseCache(apiplexConfigCache{TTL: 5, PerKey: true})
+		_, ok = perKey.storable(req, &APIContext{}, 200, cacheHeader(map[string]string{"Cache-Control": "private"}))
+		So(ok, ShouldBeFalse)
+		_, ok = perKey.storable(req, ctx, 200, cacheHeader(map[string]string{"Cache-Control": "no-store"}))
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Entries should keep the backend's headers, but nothing for this response only", t, func() {
+		upstream := cacheHeader(map[string]string{
+			"Content-Type":      "application/json",
+			"Content-Length":    "120",
+			"Etag":              `"v1"`,
+			"Connection":        "X-Hop",
+			"X-Hop":             "1",
+			"Transfer-Encoding": "chunked",
+			"X-Request-Id":      "upstream",
+		})
+		final := cacheHeader(map[string]string{
+			"Content-Type":          "application/xml",
+			"Etag":                  `"v1"`,
+			"Set-Cookie":            "session=abc",
+			"X-Request-Id":          "abc-123",
+			"X-Ratelimit-Remaining": "41",
+		})
+		h := entryHeader(upstream, final, "X-Request-Id")
+		So(h.Get("Content-Type"), ShouldEqual, "application/xml")
+		So(h.Get("Etag"), ShouldEqual, `"v1"`)
+		for _, name := range []string{"Content-Length", "Connection", "X-Hop", "Transfer-Encoding", "X-Request-Id", "Set-Cookie", "X-Ratelimit-Remaining"} {
+			So(h.Get(name), ShouldEqual, "")
+		}
+	})
+
+	Convey("Cache keys should only include the API key when asked to", t, func() {
+		So(c.baseKey(req, ctx), ShouldEqual, "cache:/x?a=1||")
+		So(newResponseCache(apiplexConfigCache{PerKey: true}).baseKey(req, ctx), ShouldEqual, "cache:/x?a=1||k1")
+	})
+
+	Convey("Vary hashes should depend on the varying headers only", t, func() {
+		a, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		a.Header.Set("Accept", "text/plain")
+		a.Header.Set("User-Agent", "one")
+		b, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		b.Header.Set("Accept", "text/plain")
+		b.Header.Set("User-Agent", "two")
+		So(varyHash(a, "accept"), ShouldEqual, varyHash(b, "Accept"))
+		So(varyHash(a, "Accept, User-Agent"), ShouldNotEqual, varyHash(b, "Accept, User-Agent"))
+	})
+}
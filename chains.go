@@ -0,0 +1,178 @@
+package apiplexy
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// The plugins a request runs through, and whether it may go without a key. There
+// is one set of chains for the global plugin lists, and every API path with plugins
+// (or a keyless policy) of its own gets another.
+type pluginChains struct {
+	auth         []AuthPlugin
+	postauth     []PostAuthPlugin
+	preupstream  []PreUpstreamPlugin
+	postupstream []PostUpstreamPlugin
+	logging      []LoggingPlugin
+	bufferBody   bool
+	keyless      bool
+}
+
+// the request plugin lists of the global plugin configuration
+func (c apiplexConfigPlugins) chains() apiplexConfigRoutePlugins {
+	return apiplexConfigRoutePlugins{
+		Auth:         c.Auth,
+		PostAuth:     c.PostAuth,
+		PreUpstream:  c.PreUpstream,
+		PostUpstream: c.PostUpstream,
+		Logging:      c.Logging,
+	}
+}
+
+// builds and typechecks the plugin chains for a set of plugin lists
+func buildChains(config apiplexConfigRoutePlugins, built *pluginSet, reusable map[string][]interface{}) (*pluginChains, error) {
+	chains := &pluginChains{}
+
+	// auth plugins
+	auth, err := buildPlugins(config.Auth, reflect.TypeOf((*AuthPlugin)(nil)).Elem(), built, reusable)
+	if err != nil {
+		return nil, err
+	}
+	chains.auth = make([]AuthPlugin, len(auth))
+	for i, p := range auth {
+		chains.auth[i] = p.(AuthPlugin)
+	}
+
+	// postauth plugins
+	postauth, err := buildPlugins(config.PostAuth, reflect.TypeOf((*PostAuthPlugin)(nil)).Elem(), built, reusable)
+	if err != nil {
+		return nil, err
+	}
+	chains.postauth = make([]PostAuthPlugin, len(postauth))
+	for i, p := range postauth {
+		chains.postauth[i] = p.(PostAuthPlugin)
+	}
+
+	// preupstream plugins
+	preupstream, err := buildPlugins(config.PreUpstream, reflect.TypeOf((*PreUpstreamPlugin)(nil)).Elem(), built, reusable)
+	if err != nil {
+		return nil, err
+	}
+	chains.preupstream = make([]PreUpstreamPlugin, len(preupstream))
+	for i, p := range preupstream {
+		chains.preupstream[i] = p.(PreUpstreamPlugin)
+	}
+
+	// postupstream plugins
+	postupstream, err := buildPlugins(config.PostUpstream, reflect.TypeOf((*PostUpstreamPlugin)(nil)).Elem(), built, reusable)
+	if err != nil {
+		return nil, err
+	}
+	chains.postupstream = make([]PostUpstreamPlugin, len(postupstream))
+	for i, p := range postupstream {
+		chains.postupstream[i] = p.(PostUpstreamPlugin)
+		if bp, ok := p.(BufferingPlugin); ok && bp.NeedsBody() {
+			chains.bufferBody = true
+		}
+	}
+
+	// logging plugins
+	logging, err := buildPlugins(config.Logging, reflect.TypeOf((*LoggingPlugin)(nil)).Elem(), built, reusable)
+	if err != nil {
+		return nil, err
+	}
+	chains.logging = make([]LoggingPlugin, len(logging))
+	for i, p := range logging {
+		chains.logging[i] = p.(LoggingPlugin)
+	}
+
+	return chains, nil
+}
+
+// Builds the chains for one API path. Route plugins run after the global ones,
+// unless the route overrides them: then each list the route gives replaces the
+// global list (an empty list switches those plugins off). Returns the global
+// chains if the route doesn't change anything.
+func buildRouteChains(api string, global *pluginChains, route apiplexConfigRoute, built *pluginSet, reusable map[string][]interface{}) (*pluginChains, error) {
+	if route.Plugins == nil && route.Keyless == nil {
+		return global, nil
+	}
+	rp := apiplexConfigRoutePlugins{}
+	if route.Plugins != nil {
+		rp = *route.Plugins
+	}
+	own, err := buildChains(rp, built, reusable)
+	if err != nil {
+		return nil, fmt.Errorf("In plugins for API path '%s': %s", api, err.Error())
+	}
+
+	chains := &pluginChains{keyless: global.keyless}
+	if route.Keyless != nil {
+		// keyless requests count against the keyless quota, so there has to be one
+		if *route.Keyless && !global.keyless {
+			return nil, fmt.Errorf("API path '%s' allows keyless requests, but there is no 'keyless' quota for them.", api)
+		}
+		chains.keyless = *route.Keyless
+	}
+	replace := func(list []apiplexPluginConfig) bool {
+		return rp.Override && list != nil
+	}
+
+	if replace(rp.Auth) {
+		chains.auth = own.auth
+	} else {
+		chains.auth = append(append([]AuthPlugin{}, global.auth...), own.auth...)
+	}
+	if replace(rp.PostAuth) {
+		chains.postauth = own.postauth
+	} else {
+		chains.postauth = append(append([]PostAuthPlugin{}, global.postauth...), own.postauth...)
+	}
+	if replace(rp.PreUpstream) {
+		chains.preupstream = own.preupstream
+	} else {
+		chains.preupstream = append(append([]PreUpstreamPlugin{}, global.preupstream...), own.preupstream...)
+	}
+	if replace(rp.PostUpstream) {
+		chains.postupstream = own.postupstream
+		chains.bufferBody = own.bufferBody
+	} else {
+		chains.postupstream = append(append([]PostUpstreamPlugin{}, global.postupstream...), own.postupstream...)
+		chains.bufferBody = global.bufferBody || own.bufferBody
+	}
+	if replace(rp.Logging) {
+		chains.logging = own.logging
+	} else {
+		chains.logging = append(append([]LoggingPlugin{}, global.logging...), own.logging...)
+	}
+	return chains, nil
+}
+
+// the chains a request runs through
+func (ap *apiplex) chainsFor(ctx *APIContext) *pluginChains {
+	if pool := ap.poolFor(ctx); pool != nil && pool.chains != nil {
+		return pool.chains
+	}
+	return ap.chains
+}
+
+// every auth plugin, global or for some API path, each one once
+func (ap *apiplex) authPlugins() []AuthPlugin {
+	all := append([]AuthPlugin{}, ap.chains.auth...)
+	seen := make(map[AuthPlugin]bool)
+	for _, a := range all {
+		seen[a] = true
+	}
+	for _, pool := range ap.upstreams {
+		if pool.chains == nil {
+			continue
+		}
+		for _, a := range pool.chains.auth {
+			if !seen[a] {
+				seen[a] = true
+				all = append(all, a)
+			}
+		}
+	}
+	return all
+}
@@ -0,0 +1,95 @@
+package apiplexy
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func TestRouteChains(t *testing.T) {
+	RegisterPlugin("reload-test", "Plugin for reload tests.", "", reloadTestPlugin{})
+	logger := func(target string) apiplexPluginConfig {
+		return apiplexPluginConfig{Plugin: "reload-test", Config: map[string]interface{}{"target": target}}
+	}
+	built := newPluginSet()
+	reusable := map[string][]interface{}{}
+	global, _ := buildChains(apiplexConfigRoutePlugins{Logging: []apiplexPluginConfig{logger("global")}}, built, reusable)
+	global.keyless = true
+
+	Convey("Routes without settings of their own should share the global chains", t, func() {
+		chains, err := buildRouteChains("/a", global, apiplexConfigRoute{}, built, reusable)
+		So(err, ShouldBeNil)
+		So(chains == global, ShouldBeTrue)
+	})
+
+	Convey("Route plugins should run after the global ones", t, func() {
+		route := apiplexConfigRoute{Plugins: &apiplexConfigRoutePlugins{Logging: []apiplexPluginConfig{logger("route")}}}
+		chains, err := buildRouteChains("/a", global, route, built, reusable)
+		So(err, ShouldBeNil)
+		So(len(chains.logging), ShouldEqual, 2)
+		So(chains.logging[0] == global.logging[0], ShouldBeTrue)
+		So(chains.logging[1].(*reloadTestPlugin).target, ShouldEqual, "route")
+		So(len(global.logging), ShouldEqual, 1)
+	})
+
+	Convey("Overriding routes should replace the lists they give", t, func() {
+		route := apiplexConfigRoute{Plugins: &apiplexConfigRoutePlugins{Override: true, Logging: []apiplexPluginConfig{}}}
+		chains, _ := buildRouteChains("/a", global, route, built, reusable)
+		So(len(chains.logging), ShouldEqual, 0)
+	})
+
+	Convey("Routes should be able to require keys", t, func() {
+		keyless := false
+		chains, _ := buildRouteChains("/a", global, apiplexConfigRoute{Keyless: &keyless}, built, reusable)
+		So(chains.keyless, ShouldBeFalse)
+		So(global.keyless, ShouldBeTrue)
+	})
+
+	Convey("Routes shouldn't allow keyless requests without a keyless quota", t, func() {
+		keyless := true
+		noKeyless := &pluginChains{keyless: false}
+		_, err := buildRouteChains("/a", noKeyless, apiplexConfigRoute{Keyless: &keyless}, built, reusable)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "'keyless' quota")
+		chains, err := buildRouteChains("/a", global, apiplexConfigRoute{Keyless: &keyless}, built, reusable)
+		So(err, ShouldBeNil)
+		So(chains.keyless, ShouldBeTrue)
+	})
+
+	Convey("Unknown route plugins should be reported with their API path", t, func() {
+		route := apiplexConfigRoute{Plugins: &apiplexConfigRoutePlugins{Logging: []apiplexPluginConfig{{Plugin: "nope"}}}}
+		_, err := buildRouteChains("/a", global, route, built, reusable)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "'/a'")
+	})
+}
+
+// a redis connection on which every quota is exceeded
+type overQuotaRedis struct {
+	memoryRedis
+}
+
+func (r overQuotaRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "EVALSHA" || cmd == "EVAL" {
+		return int64(1), nil
+	}
+	return r.memoryRedis.Do(cmd, args...)
+}
+
+func TestKeylessQuota(t *testing.T) {
+	Convey("Keyless requests over quota should be turned away by IP, not by key", t, func() {
+		ap := &apiplex{
+			ewmaScript: redis.NewScript(2, ewmaScript),
+			quotas:     map[string]apiplexQuota{"default": {Minutes: 1, MaxKey: 5}},
+		}
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		ctx := &APIContext{Keyless: true, Cost: 1, ClientIP: "10.0.0.1"}
+		So(ap.checkQuota(overQuotaRedis{memoryRedis{}}, req, ctx), ShouldBeNil)
+
+		ap.quotas["keyless"] = apiplexQuota{Minutes: 1, MaxIP: 5}
+		err := ap.checkQuota(overQuotaRedis{memoryRedis{}}, req, ctx)
+		So(err, ShouldNotBeNil)
+		So(err.(AbortRequest).Fields["per"], ShouldEqual, "ip")
+	})
+}
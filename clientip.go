@@ -0,0 +1,130 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers a proxy in front of apiplexy can use to pass on the client's address.
+const (
+	headerForwardedFor = "x-forwarded-for"
+	headerForwarded    = "forwarded"
+	headerRealIP       = "x-real-ip"
+)
+
+// A clientIPResolver works out the address of the client behind a request. Proxy
+// headers are only believed if the request came in through a trusted proxy, and
+// the forwarding chain is walked from the right, so clients can't just claim
+// another address by sending the headers themselves.
+type clientIPResolver struct {
+	trusted []*net.IPNet
+	headers []string
+}
+
+func newClientIPResolver(trustedProxies []string, headers []string) (*clientIPResolver, error) {
+	r := &clientIPResolver{}
+	for _, tp := range trustedProxies {
+		tp = strings.TrimSpace(tp)
+		if !strings.Contains(tp, "/") {
+			if strings.Contains(tp, ":") {
+				tp = tp + "/128"
+			} else {
+				tp = tp + "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(tp)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy '%s'. Use an IP address or a CIDR range.", tp)
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	if headers == nil {
+		headers = []string{headerForwardedFor}
+	}
+	for _, h := range headers {
+		h = strings.ToLower(strings.TrimSpace(h))
+		switch h {
+		case headerForwardedFor, headerForwarded, headerRealIP:
+			r.headers = append(r.headers, h)
+		default:
+			return nil, fmt.Errorf("Unknown client IP header '%s'. Use %s, %s or %s.", h, headerForwardedFor, headerForwarded, headerRealIP)
+		}
+	}
+	return r, nil
+}
+
+func (r *clientIPResolver) isTrusted(ip net.IP) bool {
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// strips ports, brackets and quotes off an address from a proxy header
+func parseHop(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), "\"")
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// the forwarding chain from one header, leftmost (original client) first
+func forwardChain(req *http.Request, header string) []string {
+	values := req.Header[http.CanonicalHeaderKey(header)]
+	chain := []string{}
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			if header != headerForwarded {
+				chain = append(chain, element)
+				continue
+			}
+			// RFC 7239: for=192.0.2.60;proto=http;by=203.0.113.43
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					chain = append(chain, kv[1])
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// resolve returns the client IP for a request.
+func (r *clientIPResolver) resolve(req *http.Request) string {
+	remote := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil || !r.isTrusted(ip) {
+		return remote
+	}
+
+	for _, h := range r.headers {
+		chain := forwardChain(req, h)
+		if len(chain) == 0 {
+			continue
+		}
+		// walk from the right: the first hop we don't trust is the client
+		closest := ip
+		for i := len(chain) - 1; i >= 0; i-- {
+			hop := parseHop(chain[i])
+			if hop == nil {
+				// obfuscated or garbage; the last hop we know of is as far as we get
+				return closest.String()
+			}
+			if !r.isTrusted(hop) {
+				return hop.String()
+			}
+			closest = hop
+		}
+		return closest.String()
+	}
+	return remote
+}
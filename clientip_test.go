@@ -0,0 +1,52 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func requestFrom(remote string, headers map[string]string) *http.Request {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = remote
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestClientIP(t *testing.T) {
+	r, err := newClientIPResolver([]string{"10.0.0.0/8", "192.168.1.1"}, []string{"forwarded", "x-forwarded-for", "x-real-ip"})
+
+	Convey("Resolver should accept CIDR ranges and single addresses", t, func() {
+		So(err, ShouldBeNil)
+		_, err := newClientIPResolver([]string{"not-an-ip"}, nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Headers from untrusted clients should be ignored", t, func() {
+		req := requestFrom("203.0.113.9:5000", map[string]string{"X-Forwarded-For": "1.2.3.4"})
+		So(r.resolve(req), ShouldEqual, "203.0.113.9")
+	})
+
+	Convey("Forwarding chain should be walked from the right", t, func() {
+		req := requestFrom("10.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 192.168.1.1"})
+		So(r.resolve(req), ShouldEqual, "198.51.100.7")
+	})
+
+	Convey("RFC 7239 Forwarded headers should be understood", t, func() {
+		req := requestFrom("10.0.0.1:5000", map[string]string{"Forwarded": `for=198.51.100.7;proto=https, for="[2001:db8::17]:4711"`})
+		So(r.resolve(req), ShouldEqual, "2001:db8::17")
+	})
+
+	Convey("X-Real-IP should be used if nothing else is there", t, func() {
+		req := requestFrom("10.0.0.1:5000", map[string]string{"X-Real-IP": "198.51.100.7"})
+		So(r.resolve(req), ShouldEqual, "198.51.100.7")
+	})
+
+	Convey("Without trusted proxies, only the remote address counts", t, func() {
+		plain, _ := newClientIPResolver(nil, nil)
+		req := requestFrom("10.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.2.3.4"})
+		So(plain.resolve(req), ShouldEqual, "10.0.0.1")
+	})
+}
@@ -0,0 +1,300 @@
+package apiplexy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var defaultCompressionTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"*+json",
+	"*+xml",
+}
+
+// A compressor compresses responses for clients that accept it, if they're big
+// enough and of a type worth compressing.
+type compressor struct {
+	encodings []string
+	minSize   int
+	types     []string
+	level     int
+}
+
+func newCompressor(config apiplexConfigCompression) (*compressor, error) {
+	c := &compressor{
+		encodings: config.Encodings,
+		minSize:   config.MinSize,
+		types:     config.Types,
+		level:     config.Level,
+	}
+	if len(c.encodings) == 0 {
+		c.encodings = []string{"gzip", "deflate"}
+	}
+	for i, e := range c.encodings {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e != "gzip" && e != "deflate" {
+			return nil, fmt.Errorf("Unknown compression '%s'. Use gzip or deflate.", e)
+		}
+		c.encodings[i] = e
+	}
+	if c.minSize <= 0 {
+		c.minSize = 1024
+	}
+	if len(c.types) == 0 {
+		c.types = defaultCompressionTypes
+	}
+	if c.level == 0 {
+		c.level = gzip.DefaultCompression
+	} else if c.level < gzip.HuffmanOnly || c.level > gzip.BestCompression {
+		return nil, fmt.Errorf("Compression level must be between %d and %d.", gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return c, nil
+}
+
+// Picks the encoding to use for a client's Accept-Encoding: the one it prefers
+// (by q-value) out of ours, or our own preference if it doesn't care. Returns ""
+// if nothing fits.
+func (c *compressor) negotiate(accept string) string {
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qs[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, e := range c.encodings {
+		q, ok := qs[e]
+		if !ok && e == "gzip" {
+			q, ok = qs["x-gzip"]
+		}
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// is a content type on the list? Entries can be exact, like application/json,
+// or wildcards: text/* for a whole family, *+json for structured suffixes.
+func (c *compressor) compressibleType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		switch {
+		case t == mt:
+			return true
+		case strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]):
+			return true
+		case strings.HasPrefix(t, "*+") && strings.HasSuffix(mt, t[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP's deflate is a zlib stream (RFC 9110, 8.4.1.2), not raw DEFLATE.
+func newEncoder(encoding string, w io.Writer, level int) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriterLevel(w, level)
+	case "deflate":
+		return zlib.NewWriterLevel(w, level)
+	}
+	return nil, fmt.Errorf("Unknown compression '%s'.", encoding)
+}
+
+// the content encoding of a response, if it's one apiplexy can undo
+func decodableEncoding(h http.Header) string {
+	switch e := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding"))); e {
+	case "gzip", "x-gzip":
+		return "gzip"
+	case "deflate":
+		return e
+	}
+	return ""
+}
+
+func decompress(encoding string, body []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// some servers send raw DEFLATE anyway
+		if r, err = zlib.NewReader(bytes.NewReader(body)); err == zlib.ErrHeader {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, fmt.Errorf("Unknown compression '%s'.", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func compress(encoding string, body []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newEncoder(encoding, &buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const (
+	compressUndecided = iota
+	compressPlain
+	compressOn
+)
+
+// A compressWriter compresses whatever the gateway sends back, once it knows
+// enough about the response: responses that are already encoded, of the wrong
+// type, marked no-transform or too small are sent as they are. Without a
+// Content-Length, the first bytes are held back until there are enough of them
+// (or the handler flushes or finishes).
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compressor
+	encoding string
+	status   int
+	state    int
+	buf      []byte
+	enc      io.WriteCloser
+}
+
+func newCompressWriter(res http.ResponseWriter, c *compressor, encoding string) *compressWriter {
+	return &compressWriter{ResponseWriter: res, c: c, encoding: encoding}
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Decides whether to compress, looking at the headers and the bytes held back so
+// far. With final set, no more bytes are coming (or they can't wait).
+func (w *compressWriter) decide(final bool) {
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	size := len(w.buf)
+	if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		size = cl
+	} else if !final && size < w.c.minSize {
+		// wait for more
+		return
+	}
+
+	w.state = compressPlain
+	switch {
+	case w.status < 200, w.status == 204, w.status == 304:
+	case h.Get("Content-Encoding") != "" && h.Get("Content-Encoding") != "identity":
+	case strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform"):
+	case size < w.c.minSize:
+	case !w.c.compressibleType(h.Get("Content-Type")):
+	default:
+		enc, err := newEncoder(w.encoding, w.ResponseWriter, w.c.level)
+		if err == nil {
+			w.state = compressOn
+			w.enc = enc
+			h.Set("Content-Encoding", w.encoding)
+			h.Del("Content-Length")
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) > 0 {
+		w.write(buf)
+	}
+}
+
+func (w *compressWriter) write(b []byte) (int, error) {
+	if w.state == compressOn {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	if w.state != compressUndecided {
+		return w.write(b)
+	}
+	w.buf = append(w.buf, b...)
+	w.decide(false)
+	return len(b), nil
+}
+
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		return
+	}
+	if w.state == compressUndecided {
+		w.decide(true)
+	}
+	if fl, ok := w.enc.(interface {
+		Flush() error
+	}); ok && w.state == compressOn {
+		fl.Flush()
+	}
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Close sends anything still held back and finishes the compressed stream.
+func (w *compressWriter) Close() error {
+	if w.status == 0 {
+		return nil
+	}
+	if w.state == compressUndecided {
+		w.decide(true)
+	}
+	if w.state == compressOn {
+		return w.enc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package apiplexy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	c, err := newCompressor(apiplexConfigCompression{MinSize: 100})
+	big := strings.Repeat(`{"hello":"world"}`, 20)
+
+	Convey("Encodings should be negotiated from Accept-Encoding", t, func() {
+		So(err, ShouldBeNil)
+		So(c.negotiate("gzip, deflate, br"), ShouldEqual, "gzip")
+		So(c.negotiate("deflate;q=1, gzip;q=0.5"), ShouldEqual, "deflate")
+		So(c.negotiate("br"), ShouldEqual, "")
+		So(c.negotiate("*"), ShouldEqual, "gzip")
+		So(c.negotiate("gzip;q=0, *;q=0.1"), ShouldEqual, "deflate")
+		So(c.negotiate(""), ShouldEqual, "")
+	})
+
+	Convey("Content types should be matched against the list", t, func() {
+		So(c.compressibleType("application/json; charset=utf-8"), ShouldBeTrue)
+		So(c.compressibleType("text/html"), ShouldBeTrue)
+		So(c.compressibleType("application/problem+json"), ShouldBeTrue)
+		So(c.compressibleType("image/png"), ShouldBeFalse)
+		So(c.compressibleType(""), ShouldBeFalse)
+	})
+
+	Convey("Big enough responses should be compressed", t, func() {
+		rec := httptest.NewRecorder()
+		w := newCompressWriter(rec, c, "gzip")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(big[:50]))
+		w.Write([]byte(big[50:]))
+		So(w.Close(), ShouldBeNil)
+		So(rec.Header().Get("Content-Encoding"), ShouldEqual, "gzip")
+		plain, err := decompress("gzip", rec.Body.Bytes())
+		So(err, ShouldBeNil)
+		So(string(plain), ShouldEqual, big)
+	})
+
+	Convey("Small responses should be sent as they are", t, func() {
+		rec := httptest.NewRecorder()
+		w := newCompressWriter(rec, c, "gzip")
+		w.WriteHeader(403)
+		w.Write([]byte(`{"error":"Access denied."}`))
+		w.Close()
+		So(rec.Code, ShouldEqual, 403)
+		So(rec.Header().Get("Content-Encoding"), ShouldEqual, "")
+		So(rec.Body.String(), ShouldEqual, `{"error":"Access denied."}`)
+	})
+
+	Convey("Already compressed responses should pass through untouched", t, func() {
+		gz, _ := compress("gzip", []byte(big), -1)
+		rec := httptest.NewRecorder()
+		w := newCompressWriter(rec, c, "deflate")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz)
+		w.Close()
+		So(rec.Header().Get("Content-Encoding"), ShouldEqual, "gzip")
+		So(rec.Body.Bytes(), ShouldResemble, gz)
+	})
+
+	Convey("Incompressible types should be sent as they are", t, func() {
+		rec := httptest.NewRecorder()
+		w := newCompressWriter(rec, c, "gzip")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(big))
+		w.Close()
+		So(rec.Header().Get("Content-Encoding"), ShouldEqual, "")
+		So(rec.Body.String(), ShouldEqual, big)
+	})
+
+	Convey("Deflate should be a zlib stream both ways", t, func() {
+		rec := httptest.NewRecorder()
+		w := newCompressWriter(rec, c, "deflate")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(big))
+		w.Close()
+		So(rec.Header().Get("Content-Encoding"), ShouldEqual, "deflate")
+		zr, err := zlib.NewReader(rec.Body)
+		So(err, ShouldBeNil)
+		plain, err := ioutil.ReadAll(zr)
+		So(err, ShouldBeNil)
+		So(string(plain), ShouldEqual, big)
+
+		var upstream bytes.Buffer
+		zw := zlib.NewWriter(&upstream)
+		zw.Write([]byte(big))
+		zw.Close()
+		plain, err = decompress("deflate", upstream.Bytes())
+		So(err, ShouldBeNil)
+		So(string(plain), ShouldEqual, big)
+	})
+
+	Convey("Raw DEFLATE from the backend should still be decoded", t, func() {
+		var upstream bytes.Buffer
+		fw, _ := flate.NewWriter(&upstream, flate.DefaultCompression)
+		fw.Write([]byte(big))
+		fw.Close()
+		plain, err := decompress("deflate", upstream.Bytes())
+		So(err, ShouldBeNil)
+		So(string(plain), ShouldEqual, big)
+	})
+
+	Convey("Unknown encodings should be rejected", t, func() {
+		_, err := newCompressor(apiplexConfigCompression{Encodings: []string{"br"}})
+		So(err, ShouldNotBeNil)
+	})
+}
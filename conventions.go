@@ -1,6 +1,7 @@
 package apiplexy
 
 import (
+	"crypto/x509"
 	"net/http"
 )
 
@@ -9,17 +10,50 @@ import (
 // to return custom 403 errors, for example. If you forget to set a status,
 // apiplexy will set 400.
 //
+// Clients get errors as RFC 7807 problem details (application/problem+json), with
+// the message as the detail. Code is a short machine-readable error code (like
+// "quota_exceeded"), Type a URI identifying the kind of problem and Title its
+// summary (the status text by default). Fields are added to the problem as extra
+// members.
+//
 // If your plugin returns a plain error, apiplexy assumes something went wrong
 // internally, and returns a generic Error 500 to the client.
 type AbortRequest struct {
 	Status  int
 	Message string
+	Code    string
+	Type    string
+	Title   string
+	Fields  map[string]interface{}
 }
 
 func (e AbortRequest) Error() string {
 	return e.Message
 }
 
+// WithCode sets the error's machine-readable code.
+func (e AbortRequest) WithCode(code string) AbortRequest {
+	e.Code = code
+	return e
+}
+
+// WithType sets the URI that identifies the kind of problem, and its title.
+func (e AbortRequest) WithType(uri string, title string) AbortRequest {
+	e.Type, e.Title = uri, title
+	return e
+}
+
+// With adds an extra field to the problem the client gets.
+func (e AbortRequest) With(field string, value interface{}) AbortRequest {
+	fields := make(map[string]interface{}, len(e.Fields)+1)
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	fields[field] = value
+	e.Fields = fields
+	return e
+}
+
 // Abort is a utility function to quickly whip up an AbortRequest.
 func Abort(status int, message string) AbortRequest {
 	return AbortRequest{Status: status, Message: message}
@@ -37,12 +71,198 @@ type apiplexConfigRedis struct {
 	DB   int
 }
 
+type apiplexConfigHealth struct {
+	Path               string
+	Interval           int `yaml:",omitempty" json:",omitempty"`
+	Timeout            int `yaml:",omitempty" json:",omitempty"`
+	Expect             int `yaml:",omitempty" json:",omitempty"`
+	HealthyThreshold   int `yaml:"healthy_threshold,omitempty" json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int `yaml:"unhealthy_threshold,omitempty" json:"unhealthy_threshold,omitempty"`
+}
+
+type apiplexConfigBreaker struct {
+	Failures    int     `yaml:",omitempty" json:",omitempty"`
+	ErrorRate   float64 `yaml:"error_rate,omitempty" json:"error_rate,omitempty"`
+	MinRequests int     `yaml:"min_requests,omitempty" json:"min_requests,omitempty"`
+	Window      int     `yaml:",omitempty" json:",omitempty"`
+	Cooldown    int     `yaml:",omitempty" json:",omitempty"`
+	Body        string  `yaml:",omitempty" json:",omitempty"`
+	ContentType string  `yaml:"content_type,omitempty" json:"content_type,omitempty"`
+}
+
+type apiplexConfigWebSocket struct {
+	MaxBytes    int64 `yaml:"max_bytes,omitempty" json:"max_bytes,omitempty"`
+	MaxMessages int64 `yaml:"max_messages,omitempty" json:"max_messages,omitempty"`
+}
+
+type apiplexConfigRetry struct {
+	Attempts   int      `yaml:",omitempty" json:",omitempty"`
+	Errors     []string `yaml:",omitempty" json:",omitempty"`
+	Statuses   []int    `yaml:",omitempty" json:",omitempty"`
+	Methods    []string `yaml:",omitempty" json:",omitempty"`
+	Backoff    int      `yaml:",omitempty" json:",omitempty"`
+	MaxBackoff int      `yaml:"max_backoff,omitempty" json:"max_backoff,omitempty"`
+}
+
+// How the gateway talks to the backends of an API path. A backend has 30 seconds
+// (or response_header_timeout) to send its response headers; the body may take as
+// long as it needs. Timeout is a deadline for the whole response on top of that,
+// so leave it off for streaming and long-polling APIs.
+type apiplexConfigTransport struct {
+	ConnectTimeout        int    `yaml:"connect_timeout,omitempty" json:"connect_timeout,omitempty"`
+	ResponseHeaderTimeout int    `yaml:"response_header_timeout,omitempty" json:"response_header_timeout,omitempty"`
+	Timeout               int    `yaml:",omitempty" json:",omitempty"`
+	MaxIdleConns          int    `yaml:"max_idle_conns,omitempty" json:"max_idle_conns,omitempty"`
+	IdleTimeout           int    `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"`
+	KeepAlive             int    `yaml:"keep_alive,omitempty" json:"keep_alive,omitempty"`
+	CACert                string `yaml:"ca_cert,omitempty" json:"ca_cert,omitempty"`
+	ClientCert            string `yaml:"client_cert,omitempty" json:"client_cert,omitempty"`
+	ClientKey             string `yaml:"client_key,omitempty" json:"client_key,omitempty"`
+	InsecureSkipVerify    bool   `yaml:"insecure_skip_verify,omitempty" json:"insecure_skip_verify,omitempty"`
+}
+
+// Caching of GET responses; TTL overrides the lifetime the backend's headers give,
+// but not private or no-store.
+type apiplexConfigCache struct {
+	TTL     int  `yaml:",omitempty" json:",omitempty"`
+	PerKey  bool `yaml:"per_key,omitempty" json:"per_key,omitempty"`
+	MaxSize int  `yaml:"max_size,omitempty" json:"max_size,omitempty"`
+}
+
+// Plugins for one API path. Unless Override is set, they run after the global ones;
+// with it, each list given here replaces the global one.
+type apiplexConfigRoutePlugins struct {
+	Override     bool                  `yaml:",omitempty" json:",omitempty"`
+	Auth         []apiplexPluginConfig `yaml:",omitempty" json:",omitempty"`
+	PostAuth     []apiplexPluginConfig `yaml:",omitempty" json:",omitempty"`
+	PreUpstream  []apiplexPluginConfig `yaml:",omitempty" json:",omitempty"`
+	PostUpstream []apiplexPluginConfig `yaml:",omitempty" json:",omitempty"`
+	Logging      []apiplexPluginConfig `yaml:",omitempty" json:",omitempty"`
+}
+
+// per-API-path settings, keyed by the same path as in Backends
+type apiplexConfigRoute struct {
+	Methods     []string                   `yaml:",omitempty" json:",omitempty"`
+	Hosts       []string                   `yaml:",omitempty" json:",omitempty"`
+	Strategy    string                     `yaml:",omitempty" json:",omitempty"`
+	Weights     map[string]int             `yaml:",omitempty" json:",omitempty"`
+	Health      *apiplexConfigHealth       `yaml:",omitempty" json:",omitempty"`
+	Breaker     *apiplexConfigBreaker      `yaml:",omitempty" json:",omitempty"`
+	WebSocket   *apiplexConfigWebSocket    `yaml:"websocket,omitempty" json:"websocket,omitempty"`
+	Retry       *apiplexConfigRetry        `yaml:",omitempty" json:",omitempty"`
+	Transport   *apiplexConfigTransport    `yaml:",omitempty" json:",omitempty"`
+	Cache       *apiplexConfigCache        `yaml:",omitempty" json:",omitempty"`
+	Plugins     *apiplexConfigRoutePlugins `yaml:",omitempty" json:",omitempty"`
+	Keyless     *bool                      `yaml:",omitempty" json:",omitempty"`
+	Rewrite     []apiplexConfigRewrite     `yaml:",omitempty" json:",omitempty"`
+	CORS        *apiplexConfigCORS         `yaml:"cors,omitempty" json:"cors,omitempty"`
+	Compression *apiplexConfigCompression  `yaml:",omitempty" json:",omitempty"`
+	Errors      *apiplexConfigErrors       `yaml:",omitempty" json:",omitempty"`
+}
+
+// Replaces the problem+json bodies of errors, e.g. to match an existing API's error
+// format. Templates (Go text/template) are keyed by status ("403"), class of status
+// ("4xx") or "default"; they get the problem's Type, Title, Status, Detail, Code,
+// RequestID and Fields, and a json function for quoting. Route templates take
+// precedence over the serve section's: all of them, so a route's "4xx" or "default"
+// wins over a "403" in the serve section.
+type apiplexConfigErrors struct {
+	ContentType string            `yaml:"content_type,omitempty" json:"content_type,omitempty"`
+	Templates   map[string]string `yaml:",omitempty" json:",omitempty"`
+}
+
+// Compresses responses for clients that accept it. Encodings (gzip, deflate) are
+// in order of preference; types are content types like application/json, text/*
+// or *+json. Responses below min_size bytes are sent as they are.
+type apiplexConfigCompression struct {
+	Encodings []string `yaml:",omitempty" json:",omitempty"`
+	MinSize   int      `yaml:"min_size,omitempty" json:"min_size,omitempty"`
+	Types     []string `yaml:",omitempty" json:",omitempty"`
+	Level     int      `yaml:",omitempty" json:",omitempty"`
+}
+
+// Lets browser apps on other origins call an API path. Origins look like
+// https://app.example.com (or https://*.example.com, or * for any); with key_realm,
+// the realm of the request's key is allowed as well. Methods default to the
+// route's methods, headers to whatever the preflight asks for. Credentials can't be
+// combined with * as an origin.
+type apiplexConfigCORS struct {
+	Origins     []string `yaml:",omitempty" json:",omitempty"`
+	KeyRealm    bool     `yaml:"key_realm,omitempty" json:"key_realm,omitempty"`
+	Methods     []string `yaml:",omitempty" json:",omitempty"`
+	Headers     []string `yaml:",omitempty" json:",omitempty"`
+	Expose      []string `yaml:",omitempty" json:",omitempty"`
+	Credentials bool     `yaml:",omitempty" json:",omitempty"`
+	MaxAge      int      `yaml:"max_age,omitempty" json:"max_age,omitempty"`
+}
+
+// Sends matching requests to a different upstream path. Match is a path template
+// like /v1/users/{id} ({rest*} takes the rest of the path), regex a regular
+// expression with (named) groups. Captured variables can be used as {id} or {1}
+// in path, query and headers. Without a path, only query and headers change.
+type apiplexConfigRewrite struct {
+	Match   string            `yaml:",omitempty" json:",omitempty"`
+	Regex   string            `yaml:",omitempty" json:",omitempty"`
+	Path    string            `yaml:",omitempty" json:",omitempty"`
+	Query   map[string]string `yaml:",omitempty" json:",omitempty"`
+	Headers map[string]string `yaml:",omitempty" json:",omitempty"`
+}
+
+type apiplexConfigTLSCert struct {
+	Cert string
+	Key  string
+}
+
+// HTTPS on its own port. With redirect, the plain HTTP port only sends clients over.
+type apiplexConfigTLS struct {
+	Port         int
+	Certificates []apiplexConfigTLSCert
+	MinVersion   string   `yaml:"min_version,omitempty" json:"min_version,omitempty"`
+	Ciphers      []string `yaml:",omitempty" json:",omitempty"`
+	ClientCA     string   `yaml:"client_ca,omitempty" json:"client_ca,omitempty"`
+	ClientAuth   string   `yaml:"client_auth,omitempty" json:"client_auth,omitempty"`
+	DisableHTTP2 bool     `yaml:"disable_http2,omitempty" json:"disable_http2,omitempty"`
+	Redirect     bool     `yaml:",omitempty" json:",omitempty"`
+}
+
+// A virtual host has its own API paths, static paths and portal API, and only
+// answers to the listed hosts (wildcards like *.example.com are allowed).
+type apiplexConfigVHost struct {
+	Hosts        []string
+	Backends     map[string][]string
+	Routes       map[string]apiplexConfigRoute `yaml:",omitempty" json:",omitempty"`
+	Static       map[string]string             `yaml:",omitempty" json:",omitempty"`
+	PortalAPI    string                        `yaml:"portal_api,omitempty" json:"portal_api,omitempty"`
+	AdminAPI     string                        `yaml:"admin_api,omitempty" json:"admin_api,omitempty"`
+	DefaultQuota string                        `yaml:"default_quota,omitempty" json:"default_quota,omitempty"`
+}
+
 type apiplexConfigServe struct {
-	Port       int
-	Backends   map[string][]string
-	Static     map[string]string
-	PortalAPI  string `yaml:"portal_api"`
-	SigningKey string `yaml:"signing_key"`
+	Port         int
+	Backends     map[string][]string
+	Routes       map[string]apiplexConfigRoute `yaml:",omitempty" json:",omitempty"`
+	Static       map[string]string
+	PortalAPI    string `yaml:"portal_api"`
+	AdminAPI     string `yaml:"admin_api,omitempty" json:"admin_api,omitempty"`
+	StatusAPI    string `yaml:"status_api,omitempty" json:"status_api,omitempty"`
+	SigningKey   string `yaml:"signing_key"`
+	WriteTimeout int    `yaml:"write_timeout,omitempty" json:"write_timeout,omitempty"`
+	DrainTimeout int    `yaml:"drain_timeout,omitempty" json:"drain_timeout,omitempty"`
+
+	// X-Request-Id unless given; "off" leaves requests without an ID
+	RequestIDHeader string `yaml:"request_id_header,omitempty" json:"request_id_header,omitempty"`
+	AuthCacheTTL    int    `yaml:"auth_cache_ttl,omitempty" json:"auth_cache_ttl,omitempty"`
+
+	TLS    *apiplexConfigTLS             `yaml:"tls,omitempty" json:"tls,omitempty"`
+	VHosts map[string]apiplexConfigVHost `yaml:"vhosts,omitempty" json:"vhosts,omitempty"`
+	CORS   *apiplexConfigCORS            `yaml:"cors,omitempty" json:"cors,omitempty"`
+
+	Compression *apiplexConfigCompression `yaml:",omitempty" json:",omitempty"`
+	Metrics     *apiplexConfigMetrics     `yaml:",omitempty" json:",omitempty"`
+	Errors      *apiplexConfigErrors      `yaml:",omitempty" json:",omitempty"`
+
+	TrustedProxies  []string `yaml:"trusted_proxies,omitempty" json:"trusted_proxies,omitempty"`
+	ClientIPHeaders []string `yaml:"client_ip_headers,omitempty" json:"client_ip_headers,omitempty"`
 }
 
 type apiplexConfigPlugins struct {
@@ -70,22 +290,45 @@ type apiplexQuota struct {
 	MaxKey  int `json:"max_key,omitempty" yaml:"max_key,omitempty"`
 }
 
+// Sends a span for every stage of a request to an OpenTelemetry collector (otlp,
+// over HTTP with JSON) or appends them to a file. Sample rate is the share of
+// requests to trace, unless the client already decided with its traceparent.
+type apiplexConfigTracing struct {
+	Exporter    string            `yaml:",omitempty" json:",omitempty"`
+	Endpoint    string            `yaml:",omitempty" json:",omitempty"`
+	Headers     map[string]string `yaml:",omitempty" json:",omitempty"`
+	File        string            `yaml:",omitempty" json:",omitempty"`
+	ServiceName string            `yaml:"service_name,omitempty" json:"service_name,omitempty"`
+	SampleRate  float64           `yaml:"sample_rate,omitempty" json:"sample_rate,omitempty"`
+}
+
+// Serves Prometheus metrics at Path (/metrics by default). With a Port, they get
+// a listener of their own, so they don't have to be reachable by API clients.
+type apiplexConfigMetrics struct {
+	Path string `yaml:",omitempty" json:",omitempty"`
+	Port int    `yaml:",omitempty" json:",omitempty"`
+}
+
 type ApiplexConfig struct {
 	Redis   apiplexConfigRedis
 	Email   apiplexConfigEmail
 	Quotas  map[string]apiplexQuota
 	Serve   apiplexConfigServe
 	Plugins apiplexConfigPlugins
+	Tracing *apiplexConfigTracing `yaml:",omitempty" json:",omitempty"`
 }
 
 // User represents a user (or developer) who can create and use keys in their
 // app. Users are uniquely identified by their emails, and that's really all
 // the management plugins need. You are free to put additional profile data
 // into the Data field, as long as it can be serialized to JSON.
+//
+// Admin users may use the admin API, if your backend plugin supports it.
 type User struct {
 	Email   string                 `json:"email"`
 	Name    string                 `json:"name"`
 	Active  bool                   `json:"active"`
+	Admin   bool                   `json:"admin,omitempty"`
 	Profile map[string]interface{} `json:"profile,omitempty"`
 }
 
@@ -99,32 +342,55 @@ type User struct {
 // The key's owner is an email address (hopefully found in one of the backing stores.
 // Keys do not require an owner, but ownerless keys don't trigger any quota overage
 // notifications (for obvious reasons).
+//
+// Suspended keys are turned away, even if they are otherwise valid.
 type Key struct {
-	ID    string                 `json:"id"`
-	Realm string                 `json:"realm"`
-	Quota string                 `json:"quota"`
-	Type  string                 `json:"type"`
-	Owner string                 `json:"-"`
-	Data  map[string]interface{} `json:"data,omitempty"`
+	ID        string                 `json:"id"`
+	Realm     string                 `json:"realm"`
+	Quota     string                 `json:"quota"`
+	Type      string                 `json:"type"`
+	Owner     string                 `json:"-"`
+	Suspended bool                   `json:"suspended,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
 }
 
 // An APIContext map accompanies every API request through its lifecycle. Use this
 // to store data that will be available to plugins down the chain.
 //
+// ClientIP is the address of the client that made the request, as resolved through
+// the configured trusted proxies. Plugins should always use it rather than looking
+// at X-Forwarded-For and friends themselves.
+//
+// RequestID identifies the request in logs, alert emails, error responses and the
+// request to the backend. It comes from the client if they sent one along.
+//
+// VHost is the name of the virtual host the request went to, or empty for the
+// default host.
+//
+// If the client presented a TLS certificate that was verified against the configured
+// client CA, ClientCerts holds the verified chain, starting with the client's own
+// certificate.
+//
 // As a convention, Logging plugins MUST log everything stored under Log. Log MUST
 // at least(!) be kept JSON-serializable; or better yet, as a map from strings to
 // plain types.
 type APIContext struct {
-	Keyless  bool
-	Key      *Key
-	Cost     int
-	Path     string
-	Upstream *APIUpstream
-	DoNotLog bool
-	APIPath  string
-	ClientIP string
-	Log      map[string]interface{}
-	Data     map[string]interface{}
+	Keyless     bool
+	Key         *Key
+	Cost        int
+	Path        string
+	Upstream    *APIUpstream
+	DoNotLog    bool
+	APIPath     string
+	RequestID   string
+	VHost       string
+	ClientIP    string
+	ClientCerts []*x509.Certificate
+	Log         map[string]interface{}
+	Data        map[string]interface{}
+
+	trace  *requestTrace
+	errors *errorRenderer
 }
 
 // Description of a key type that an AuthPlugin may offer.
@@ -227,12 +493,34 @@ type ManagementBackendPlugin interface {
 	GetAllKeys(email string) ([]*Key, error)
 }
 
+// An AdminBackendPlugin is a ManagementBackendPlugin that also lets operators
+// manage all users and keys through the admin API.
+//
+// FindUsers and FindKeys return up to limit results, starting at offset. An empty
+// query finds everything; otherwise FindUsers looks for the query in users' emails
+// and names, and FindKeys in key IDs and owners.
+//
+// GetKeyByID MUST fill in the key's Owner. UpdateKey stores a key's realm, quota
+// and suspension; it MUST NOT change its ID, type or owner. Suspended keys, and
+// the keys of inactive users, should not be returned by GetKey anymore.
+//
+// DeleteUser deletes the user's keys along with the user.
+type AdminBackendPlugin interface {
+	ManagementBackendPlugin
+	FindUsers(query string, offset, limit int) ([]*User, error)
+	SetUserActive(email string, active bool) error
+	DeleteUser(email string) error
+	FindKeys(query string, offset, limit int) ([]*Key, error)
+	GetKeyByID(keyID string) (*Key, error)
+	UpdateKey(key *Key) error
+}
+
 // A plugin that runs immediately after authentication (so the request is valid
 // and generally allowed), but before the quota is checked. Use this to restrict
 // access or modify cost based on things like the request's path. apiplexy checks
 // the context's "cost" entry during quota calculations.
 //
-//  ctx.Cost = 3
+//	ctx.Cost = 3
 type PostAuthPlugin interface {
 	Plugin
 	PostAuth(req *http.Request, ctx *APIContext) error
@@ -249,12 +537,25 @@ type PreUpstreamPlugin interface {
 
 // A PostUpstreamPlugin runs after the request has been handled by upstream, and
 // receives an additional "res" parameter. This is the response returned by upstream.
-// You can modify the response body here.
+// You can modify the response headers here.
+//
+// Upstream responses are streamed through to the client as they arrive, so by
+// default res.Body has not been read yet and MUST NOT be consumed by your plugin.
+// If you need to inspect or modify the body, implement BufferingPlugin as well.
 type PostUpstreamPlugin interface {
 	Plugin
 	PostUpstream(req *http.Request, res *http.Response, ctx *APIContext) error
 }
 
+// A PostUpstreamPlugin that also implements BufferingPlugin and returns true from
+// NeedsBody will receive the fully buffered upstream response. You can then read
+// res.Body freely, or replace it with a modified body; apiplexy will fix up the
+// Content-Length before sending it on. Note that buffering holds the complete
+// response in memory, so only ask for it if you really need it.
+type BufferingPlugin interface {
+	NeedsBody() bool
+}
+
 // LoggingPlugins are run after the main request has already completed and the response
 // has been sent back to the user. Modifying the response will have no effect. This
 // stage is (as the name implies) best suited for logging plugins.
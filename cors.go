@@ -0,0 +1,169 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// A corsPolicy decides which web origins may call an API path from the browser.
+// Preflights are answered at the gateway; actual requests get their CORS headers
+// from the gateway too, replacing whatever the backend sends.
+type corsPolicy struct {
+	origins     []string
+	keyRealm    bool
+	methods     map[string]bool
+	allowMethod string
+	headers     string
+	expose      string
+	credentials bool
+	maxAge      int
+}
+
+func newCORSPolicy(api string, config apiplexConfigCORS, routeMethods []string) (*corsPolicy, error) {
+	c := &corsPolicy{
+		keyRealm:    config.KeyRealm,
+		credentials: config.Credentials,
+		maxAge:      config.MaxAge,
+		headers:     strings.Join(config.Headers, ", "),
+		expose:      strings.Join(config.Expose, ", "),
+	}
+	if len(config.Origins) == 0 && !c.keyRealm {
+		return nil, fmt.Errorf("CORS for API path '%s' needs allowed origins, key_realm, or both.", api)
+	}
+	for _, o := range config.Origins {
+		o = strings.ToLower(strings.TrimRight(strings.TrimSpace(o), "/"))
+		if o != "*" && !strings.Contains(o, "://") {
+			return nil, fmt.Errorf("CORS origin '%s' for API path '%s' should look like https://app.example.com.", o, api)
+		}
+		// any website could make requests with the user's cookies
+		if o == "*" && c.credentials {
+			return nil, fmt.Errorf("CORS for API path '%s' can't allow credentials from any origin ('*'). List the origins instead.", api)
+		}
+		c.origins = append(c.origins, o)
+	}
+
+	methods := config.Methods
+	if len(methods) == 0 {
+		methods = routeMethods
+	}
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	c.methods = make(map[string]bool, len(methods))
+	for i, m := range methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		c.methods[m] = true
+		if i > 0 {
+			c.allowMethod += ", "
+		}
+		c.allowMethod += m
+	}
+	return c, nil
+}
+
+// is this an OPTIONS request a browser sends to ask for permission first?
+func isPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// does an origin (scheme://host[:port]) match a configured one? Configured origins
+// can use a wildcard for subdomains, like https://*.example.com.
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	ps := strings.SplitN(pattern, "://", 2)
+	os := strings.SplitN(origin, "://", 2)
+	if len(ps) != 2 || len(os) != 2 || ps[0] != os[0] {
+		return false
+	}
+	return hostMatches(ps[1], os[1])
+}
+
+// the host of an origin, without scheme and port
+func originHost(origin string) string {
+	if i := strings.Index(origin, "://"); i >= 0 {
+		origin = origin[i+3:]
+	}
+	if i := strings.LastIndex(origin, ":"); i >= 0 {
+		origin = origin[:i]
+	}
+	return origin
+}
+
+// May the origin call the API? With key_realm, an origin is also allowed if its
+// host is the realm of the request's key (or, for realms like *.example.com, a
+// subdomain of it).
+func (c *corsPolicy) allowed(origin string, key *Key) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.origins {
+		if originMatches(o, origin) {
+			return true
+		}
+	}
+	if c.keyRealm && key != nil && key.Realm != "" {
+		return hostMatches(strings.ToLower(key.Realm), originHost(origin))
+	}
+	return false
+}
+
+// Answers a preflight. Preflights carry no credentials, so with key_realm the key
+// isn't known yet: any origin gets through here, and the actual request is checked
+// against the key's realm.
+func (c *corsPolicy) preflight(res http.ResponseWriter, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if !c.keyRealm && !c.allowed(origin, nil) {
+		return Abort(403, fmt.Sprintf("Origin '%s' may not call this API.", origin)).WithCode("origin_not_allowed")
+	}
+	method := strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+	if !c.methods[method] {
+		return Abort(403, fmt.Sprintf("Method %s is not allowed for cross-origin requests.", method)).WithCode("method_not_allowed")
+	}
+	h := res.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	h.Set("Access-Control-Allow-Methods", c.allowMethod)
+	if c.headers != "" {
+		h.Set("Access-Control-Allow-Headers", c.headers)
+	} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.maxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(c.maxAge))
+	}
+	res.WriteHeader(204)
+	return nil
+}
+
+// Adds CORS headers to the response of an actual (non-preflight) request if its
+// origin is allowed. Returns whether it did.
+func (c *corsPolicy) decorate(h http.Header, req *http.Request, key *Key) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" || !c.allowed(origin, key) {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.expose != "" {
+		h.Set("Access-Control-Expose-Headers", c.expose)
+	}
+	return true
+}
+
+// removes the backend's own CORS headers, so they don't contradict the gateway's
+func stripCORS(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(h, k)
+		}
+	}
+}
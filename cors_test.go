@@ -0,0 +1,97 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func preflightRequest(origin, method string) *http.Request {
+	req, _ := http.NewRequest("OPTIONS", "http://gateway/v1/users", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	return req
+}
+
+func TestCORS(t *testing.T) {
+	c, err := newCORSPolicy("/v1", apiplexConfigCORS{
+		Origins:     []string{"https://app.example.com", "https://*.partner.com/"},
+		Credentials: true,
+		MaxAge:      600,
+		Expose:      []string{"X-Total"},
+	}, []string{"get", "post"})
+
+	Convey("Configured origins should be allowed", t, func() {
+		So(err, ShouldBeNil)
+		So(c.allowed("https://app.example.com", nil), ShouldBeTrue)
+		So(c.allowed("https://eu.partner.com", nil), ShouldBeTrue)
+		So(c.allowed("http://app.example.com", nil), ShouldBeFalse)
+		So(c.allowed("https://evil.com", nil), ShouldBeFalse)
+	})
+
+	Convey("Preflights should be answered for allowed origins and methods", t, func() {
+		w := httptest.NewRecorder()
+		So(c.preflight(w, preflightRequest("https://app.example.com", "POST")), ShouldBeNil)
+		So(w.Code, ShouldEqual, 204)
+		So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.com")
+		So(w.Header().Get("Access-Control-Allow-Methods"), ShouldEqual, "GET, POST")
+		So(w.Header().Get("Access-Control-Allow-Headers"), ShouldEqual, "Authorization")
+		So(w.Header().Get("Access-Control-Allow-Credentials"), ShouldEqual, "true")
+		So(w.Header().Get("Access-Control-Max-Age"), ShouldEqual, "600")
+
+		So(c.preflight(httptest.NewRecorder(), preflightRequest("https://evil.com", "GET")), ShouldNotBeNil)
+		So(c.preflight(httptest.NewRecorder(), preflightRequest("https://app.example.com", "DELETE")), ShouldNotBeNil)
+	})
+
+	Convey("Key realms should allow their origins", t, func() {
+		r, _ := newCORSPolicy("/v1", apiplexConfigCORS{KeyRealm: true}, nil)
+		So(r.allowed("https://shop.example.com:8443", &Key{Realm: "shop.example.com"}), ShouldBeTrue)
+		So(r.allowed("https://a.example.com", &Key{Realm: "*.example.com"}), ShouldBeTrue)
+		So(r.allowed("https://other.com", &Key{Realm: "shop.example.com"}), ShouldBeFalse)
+		So(r.allowed("https://shop.example.com", nil), ShouldBeFalse)
+		// the key isn't known yet during preflight
+		So(r.preflight(httptest.NewRecorder(), preflightRequest("https://shop.example.com", "GET")), ShouldBeNil)
+	})
+
+	Convey("Responses should only get CORS headers for allowed origins", t, func() {
+		req, _ := http.NewRequest("GET", "http://gateway/v1/users", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		h := http.Header{}
+		So(c.decorate(h, req, nil), ShouldBeTrue)
+		So(h.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.com")
+		So(h.Get("Access-Control-Expose-Headers"), ShouldEqual, "X-Total")
+
+		req.Header.Set("Origin", "https://evil.com")
+		h = http.Header{}
+		So(c.decorate(h, req, nil), ShouldBeFalse)
+		So(h.Get("Access-Control-Allow-Origin"), ShouldEqual, "")
+	})
+
+	Convey("Preflights should be routed by the method they ask about", t, func() {
+		r := newRouter([]*apiRoute{
+			newRoute("/v1", apiplexConfigRoute{Methods: []string{"POST"}}, nil),
+			newRoute("/", apiplexConfigRoute{}, nil),
+		})
+		So(r.match(preflightRequest("https://app.example.com", "POST")).api, ShouldEqual, "/v1")
+		So(r.match(preflightRequest("https://app.example.com", "GET")).api, ShouldEqual, "/")
+	})
+
+	Convey("Policies without origins should be rejected", t, func() {
+		_, err := newCORSPolicy("/v1", apiplexConfigCORS{}, nil)
+		So(err, ShouldNotBeNil)
+		_, err = newCORSPolicy("/v1", apiplexConfigCORS{Origins: []string{"app.example.com"}}, nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Credentials shouldn't be allowed from any origin", t, func() {
+		_, err := newCORSPolicy("/v1", apiplexConfigCORS{Origins: []string{"*"}, Credentials: true}, nil)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "'/v1'")
+		_, err = newCORSPolicy("/v1", apiplexConfigCORS{Origins: []string{"*"}}, nil)
+		So(err, ShouldBeNil)
+		_, err = newCORSPolicy("/v1", apiplexConfigCORS{Origins: []string{"https://*.example.com"}, Credentials: true}, nil)
+		So(err, ShouldBeNil)
+	})
+}
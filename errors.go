@@ -0,0 +1,146 @@
+package apiplexy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"text/template"
+)
+
+// A problem is an error as the client gets to see it: an RFC 7807 problem details
+// object, with the error code, request ID and any extra fields as extension members.
+// Error templates get it as their data.
+type problem struct {
+	Type      string
+	Title     string
+	Status    int
+	Detail    string
+	Code      string
+	RequestID string
+	Fields    map[string]interface{}
+}
+
+func newProblem(status int, err error, requestID string) *problem {
+	p := &problem{Status: status, Detail: err.Error(), RequestID: requestID}
+	if e, ok := err.(AbortRequest); ok {
+		p.Status, p.Type, p.Title, p.Code, p.Fields = e.Status, e.Type, e.Title, e.Code, e.Fields
+		if p.Status == 0 {
+			p.Status = 400
+		}
+	} else {
+		p.Code = "internal_error"
+	}
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	return p
+}
+
+func (p *problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(p.Fields)+6)
+	// extra fields can't take the place of the standard ones
+	for k, v := range p.Fields {
+		m[k] = v
+	}
+	m["type"] = p.Type
+	m["title"] = p.Title
+	m["status"] = p.Status
+	m["detail"] = p.Detail
+	if p.Code != "" {
+		m["code"] = p.Code
+	}
+	if p.RequestID != "" {
+		m["request_id"] = p.RequestID
+	}
+	return json.Marshal(m)
+}
+
+// An errorRenderer writes problems in the format the operator asked for: problem+json,
+// unless there's a template for the status (like "403"), its class ("4xx") or a
+// "default" one. A route's renderer goes through all of its own templates before
+// it falls back to the serve section's, so a route's "default" beats a serve "403".
+type errorRenderer struct {
+	contentType string
+	templates   map[string]*template.Template
+	base        *errorRenderer
+}
+
+var errorTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+var errorTemplateName = regexp.MustCompile(`^([1-5][0-9][0-9]|[1-5]xx|default)$`)
+
+func newErrorRenderer(config *apiplexConfigErrors) (*errorRenderer, error) {
+	return (*errorRenderer)(nil).extend(config)
+}
+
+// builds a renderer with the templates of config, falling back to er's
+func (er *errorRenderer) extend(config *apiplexConfigErrors) (*errorRenderer, error) {
+	next := &errorRenderer{templates: make(map[string]*template.Template), base: er}
+	if er != nil {
+		next.contentType = er.contentType
+	}
+	if config == nil {
+		return next, nil
+	}
+	if config.ContentType != "" {
+		next.contentType = config.ContentType
+	}
+	for name, text := range config.Templates {
+		if !errorTemplateName.MatchString(name) {
+			return nil, fmt.Errorf("Error templates are for a status (like 403), a class of statuses (4xx) or the default; '%s' is none of these.", name)
+		}
+		t, err := template.New(name).Funcs(errorTemplateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("Error template '%s' doesn't parse. %s", name, err.Error())
+		}
+		next.templates[name] = t
+	}
+	return next, nil
+}
+
+// finds the template for a status, along with the content type that goes with it
+func (er *errorRenderer) template(status int) (*template.Template, string) {
+	names := []string{fmt.Sprintf("%d", status), fmt.Sprintf("%dxx", status/100), "default"}
+	for r := er; r != nil; r = r.base {
+		for _, name := range names {
+			if t, ok := r.templates[name]; ok {
+				return t, r.contentType
+			}
+		}
+	}
+	return nil, ""
+}
+
+// a template that fails to execute falls back to problem+json, so the client gets
+// an error either way
+func (er *errorRenderer) render(res http.ResponseWriter, p *problem) {
+	var body []byte
+	contentType := "application/problem+json"
+	if t, ct := er.template(p.Status); t != nil {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, p); err == nil {
+			body = buf.Bytes()
+			contentType = ct
+			if contentType == "" {
+				contentType = "application/json"
+			}
+		}
+	}
+	if body == nil {
+		body, _ = json.Marshal(p)
+	}
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Del("Content-Length")
+	res.WriteHeader(p.Status)
+	res.Write(body)
+}
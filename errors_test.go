@@ -0,0 +1,110 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProblems(t *testing.T) {
+	ap := &apiplex{}
+	render := func(er *errorRenderer, status int, err error) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ap.error(status, err, w, &APIContext{RequestID: "abc-123", errors: er})
+		return w
+	}
+
+	Convey("Errors should be problem+json by default", t, func() {
+		w := render(nil, 500, Abort(403, "Over quota.").WithCode("quota_exceeded").With("limit", 50))
+		So(w.Code, ShouldEqual, 403)
+		So(w.Header().Get("Content-Type"), ShouldEqual, "application/problem+json")
+		var p map[string]interface{}
+		So(json.Unmarshal(w.Body.Bytes(), &p), ShouldBeNil)
+		So(p["type"], ShouldEqual, "about:blank")
+		So(p["title"], ShouldEqual, "Forbidden")
+		So(p["status"], ShouldEqual, 403.0)
+		So(p["detail"], ShouldEqual, "Over quota.")
+		So(p["code"], ShouldEqual, "quota_exceeded")
+		So(p["request_id"], ShouldEqual, "abc-123")
+		So(p["limit"], ShouldEqual, 50.0)
+	})
+
+	Convey("Type and title should be taken from the abort", t, func() {
+		w := render(nil, 500, Abort(402, "Pay up.").WithType("https://example.com/problems/payment", "Payment needed"))
+		var p map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &p)
+		So(p["type"], ShouldEqual, "https://example.com/problems/payment")
+		So(p["title"], ShouldEqual, "Payment needed")
+	})
+
+	Convey("Extra fields shouldn't replace the standard members", t, func() {
+		w := render(nil, 500, Abort(403, "No.").With("status", 200))
+		var p map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &p)
+		So(p["status"], ShouldEqual, 403.0)
+	})
+
+	Convey("Aborts without a status should be 400s, other errors internal", t, func() {
+		So(render(nil, 500, AbortRequest{Message: "Bad."}).Code, ShouldEqual, 400)
+		w := render(nil, 500, fmt.Errorf("Broken."))
+		So(w.Code, ShouldEqual, 500)
+		So(w.Body.String(), ShouldContainSubstring, `"code":"internal_error"`)
+	})
+
+	Convey("Templates should be picked by status, then class, then default", t, func() {
+		er, err := newErrorRenderer(&apiplexConfigErrors{Templates: map[string]string{
+			"403":     `{"error": {{json .Detail}}, "code": {{json .Code}}}`,
+			"5xx":     `{"error": "Server trouble"}`,
+			"default": `{"error": {{json .Title}}}`,
+		}})
+		So(err, ShouldBeNil)
+		w := render(er, 403, Abort(403, `Say "no".`).WithCode("nope"))
+		So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+		So(w.Body.String(), ShouldEqual, `{"error": "Say \"no\".", "code": "nope"}`)
+		So(render(er, 502, Abort(502, "Down.")).Body.String(), ShouldEqual, `{"error": "Server trouble"}`)
+		So(render(er, 404, Abort(404, "Gone.")).Body.String(), ShouldEqual, `{"error": "Not Found"}`)
+	})
+
+	Convey("Route templates should go on top of the serve section's", t, func() {
+		base, _ := newErrorRenderer(&apiplexConfigErrors{Templates: map[string]string{
+			"403": `serve 403`,
+			"404": `serve 404`,
+		}})
+		route, err := base.extend(&apiplexConfigErrors{ContentType: "text/plain", Templates: map[string]string{
+			"403": `route 403`,
+		}})
+		So(err, ShouldBeNil)
+		w := render(route, 403, Abort(403, "No."))
+		So(w.Body.String(), ShouldEqual, "route 403")
+		So(w.Header().Get("Content-Type"), ShouldEqual, "text/plain")
+		So(render(route, 404, Abort(404, "Gone.")).Body.String(), ShouldEqual, "serve 404")
+		So(render(base, 403, Abort(403, "No.")).Body.String(), ShouldEqual, "serve 403")
+	})
+
+	Convey("Any route template should win over the serve section's", t, func() {
+		base, _ := newErrorRenderer(&apiplexConfigErrors{ContentType: "text/xml", Templates: map[string]string{
+			"403": `serve 403`,
+			"5xx": `serve 5xx`,
+		}})
+		route, _ := base.extend(&apiplexConfigErrors{ContentType: "text/plain", Templates: map[string]string{
+			"4xx": `route 4xx`,
+		}})
+		So(render(route, 403, Abort(403, "No.")).Body.String(), ShouldEqual, "route 4xx")
+		w := render(route, 502, Abort(502, "Down."))
+		So(w.Body.String(), ShouldEqual, "serve 5xx")
+		So(w.Header().Get("Content-Type"), ShouldEqual, "text/xml")
+
+		fallback, _ := base.extend(&apiplexConfigErrors{Templates: map[string]string{"default": `route default`}})
+		So(render(fallback, 403, Abort(403, "No.")).Body.String(), ShouldEqual, "route default")
+		So(render(fallback, 502, Abort(502, "Down.")).Body.String(), ShouldEqual, "route default")
+	})
+
+	Convey("Bad templates should be rejected", t, func() {
+		_, err := newErrorRenderer(&apiplexConfigErrors{Templates: map[string]string{"4XX": "x"}})
+		So(err, ShouldNotBeNil)
+		_, err = newErrorRenderer(&apiplexConfigErrors{Templates: map[string]string{"403": "{{.Detail"}})
+		So(err, ShouldNotBeNil)
+	})
+}
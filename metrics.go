@@ -0,0 +1,233 @@
+package apiplexy
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are kept for the whole process, so counters keep counting through
+// configuration reloads. They're served in the Prometheus text format.
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64
+	sum    float64
+}
+
+// A metric is a counter or histogram with a fixed set of label names.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*metricSeries
+}
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+	if kind == "histogram" {
+		m.buckets = latencyBuckets
+	}
+	return m
+}
+
+func (m *metric) get(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: values}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) inc(values ...string) {
+	m.mutex.Lock()
+	m.get(values).value++
+	m.mutex.Unlock()
+}
+
+func (m *metric) observe(v float64, values ...string) {
+	m.mutex.Lock()
+	s := m.get(values)
+	s.value++
+	s.sum += v
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	m.mutex.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		parts = append(parts, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", m.name, formatLabels(m.labels, s.labels, "le", "+Inf"), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.value))
+	}
+}
+
+// requests whose logging plugins haven't run yet, across reloads
+var loggingBacklog int64
+
+var stats = struct {
+	requests        *metric
+	latency         *metric
+	quotaRejections *metric
+	authCache       *metric
+	upstreamErrors  *metric
+	pluginErrors    *metric
+	all             []*metric
+}{
+	requests:        newMetric("counter", "apiplexy_requests_total", "API requests handled, by virtual host, API path, status and key type.", "vhost", "api_path", "status", "key_type"),
+	latency:         newMetric("histogram", "apiplexy_request_duration_seconds", "Time taken to handle API requests.", "vhost", "api_path", "status", "key_type"),
+	quotaRejections: newMetric("counter", "apiplexy_quota_rejections_total", "Requests rejected for going over quota, by quota and whether the IP or key limit was hit.", "quota", "limit"),
+	authCache:       newMetric("counter", "apiplexy_auth_cache_total", "Key lookups in the auth cache, by result (hit or miss).", "result"),
+	upstreamErrors:  newMetric("counter", "apiplexy_upstream_errors_total", "Failed upstream requests (connection errors and 5xx responses), by virtual host, API path and backend.", "vhost", "api_path", "upstream"),
+	pluginErrors:    newMetric("counter", "apiplexy_plugin_errors_total", "Errors returned by plugins (not counting deliberate aborts), by plugin and stage.", "plugin", "stage"),
+}
+
+func init() {
+	stats.all = []*metric{stats.requests, stats.latency, stats.quotaRejections, stats.authCache, stats.upstreamErrors, stats.pluginErrors}
+}
+
+// counts a plugin error, unless the plugin just aborted the request on purpose
+func countPluginError(stage string, plugin interface{}, err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(AbortRequest); ok {
+		return
+	}
+	stats.pluginErrors.inc(pluginName(plugin), stage)
+}
+
+// counts a finished request
+func countRequest(ctx *APIContext, status int, took time.Duration) {
+	keyType := "none"
+	if ctx.Key != nil {
+		keyType = ctx.Key.Type
+	} else if ctx.Keyless {
+		keyType = "keyless"
+	}
+	if status == 0 {
+		status = 200
+	}
+	s := strconv.Itoa(status)
+	stats.requests.inc(ctx.VHost, ctx.APIPath, s, keyType)
+	stats.latency.observe(took.Seconds(), ctx.VHost, ctx.APIPath, s, keyType)
+}
+
+// A statusWriter notes the status of the response that goes through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// upgraded connections count as 101 once they're taken over
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection can't be taken over.")
+	}
+	c, rw, err := hj.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return c, rw, err
+}
+
+// Metrics serves the gateway's metrics, along with the current state of its
+// Redis pool and logging backlog, in the Prometheus text format.
+func (ap *apiplex) Metrics(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(res)
+	for _, m := range stats.all {
+		m.write(w)
+	}
+	if ap.redis != nil {
+		fmt.Fprintf(w, "# HELP apiplexy_redis_connections Connections in the Redis pool, by state.\n# TYPE apiplexy_redis_connections gauge\n")
+		fmt.Fprintf(w, "apiplexy_redis_connections{state=\"active\"} %d\n", ap.redis.ActiveCount())
+		fmt.Fprintf(w, "apiplexy_redis_connections{state=\"idle\"} %d\n", ap.redis.IdleCount())
+	}
+	fmt.Fprintf(w, "# HELP apiplexy_logging_backlog Requests waiting for their logging plugins to run.\n# TYPE apiplexy_logging_backlog gauge\n")
+	fmt.Fprintf(w, "apiplexy_logging_backlog %d\n", atomic.LoadInt64(&loggingBacklog))
+	w.Flush()
+}
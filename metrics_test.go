@@ -0,0 +1,84 @@
+package apiplexy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	Convey("Counters should be written in the Prometheus text format", t, func() {
+		m := newMetric("counter", "test_total", "Test counter.", "path", "result")
+		m.inc("/b", "ok")
+		m.inc("/a", `say "hi"`)
+		m.inc("/b", "ok")
+
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		m.write(w)
+		w.Flush()
+		So(buf.String(), ShouldEqual, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{path="/a",result="say \"hi\""} 1
+test_total{path="/b",result="ok"} 2
+`)
+	})
+
+	Convey("Histograms should have cumulative buckets, a sum and a count", t, func() {
+		m := newMetric("histogram", "test_seconds", "Test histogram.", "path")
+		m.observe(0.02, "/a")
+		m.observe(3, "/a")
+
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		m.write(w)
+		w.Flush()
+		So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{path="/a",le="0.01"} 0`)
+		So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{path="/a",le="0.025"} 1`)
+		So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{path="/a",le="5"} 2`)
+		So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{path="/a",le="+Inf"} 2`)
+		So(buf.String(), ShouldContainSubstring, `test_seconds_sum{path="/a"} 3.02`)
+		So(buf.String(), ShouldContainSubstring, `test_seconds_count{path="/a"} 2`)
+	})
+
+	Convey("Requests should be counted by virtual host, API path, status and key type", t, func() {
+		countRequest(&APIContext{APIPath: "/metrics-test", Key: &Key{Type: "HMAC"}}, 201, 10*time.Millisecond)
+		countRequest(&APIContext{APIPath: "/metrics-test", Keyless: true}, 0, time.Millisecond)
+		countRequest(&APIContext{APIPath: "/metrics-test", VHost: "partners", Keyless: true}, 0, time.Millisecond)
+
+		rec := httptest.NewRecorder()
+		(&apiplex{}).Metrics(rec, nil)
+		So(rec.Body.String(), ShouldContainSubstring, `apiplexy_requests_total{vhost="",api_path="/metrics-test",status="201",key_type="HMAC"} 1`)
+		So(rec.Body.String(), ShouldContainSubstring, `apiplexy_requests_total{vhost="",api_path="/metrics-test",status="200",key_type="keyless"} 1`)
+		So(rec.Body.String(), ShouldContainSubstring, `apiplexy_requests_total{vhost="partners",api_path="/metrics-test",status="200",key_type="keyless"} 1`)
+		So(rec.Body.String(), ShouldContainSubstring, "apiplexy_logging_backlog 0")
+	})
+
+	Convey("Plugin errors should be counted, but not deliberate aborts", t, func() {
+		countPluginError("logging", &reloadTestPlugin{}, Abort(403, "No."))
+		countPluginError("logging", &reloadTestPlugin{}, nil)
+		countPluginError("logging", &reloadTestPlugin{}, fmt.Errorf("Broken."))
+
+		rec := httptest.NewRecorder()
+		(&apiplex{}).Metrics(rec, nil)
+		So(rec.Body.String(), ShouldContainSubstring, `apiplexy_plugin_errors_total{plugin="apiplexy.reloadTestPlugin",stage="logging"} 1`)
+	})
+
+	Convey("The status writer should note the response status", t, func() {
+		sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+		sw.Write([]byte("hello"))
+		sw.WriteHeader(500)
+		So(sw.status, ShouldEqual, 200)
+
+		sw = &statusWriter{ResponseWriter: httptest.NewRecorder()}
+		sw.WriteHeader(404)
+		So(sw.status, ShouldEqual, 404)
+		_, ok := interface{}(sw).(http.Flusher)
+		So(ok, ShouldBeTrue)
+	})
+}
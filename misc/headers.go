@@ -0,0 +1,165 @@
+package misc
+
+import (
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// matches {client_ip}, {key.id}, {key.data.plan} etc. in header values
+var headerVar = regexp.MustCompile(`\{([\w.-]+)\}`)
+
+// HeaderPlugin changes headers. As a preupstream plugin it works on the request
+// going to the backend, as a postupstream plugin on the response coming back.
+// Headers are removed first, then renamed, set and appended to. Values can use
+// {client_ip}, {key.id}, {key.owner}, {key.type}, {key.quota}, {key.realm} and
+// {key.data.<field>}. If one of its variables is empty (say, {key.id} on a keyless
+// request), a header that is set is removed instead, so clients can't send it
+// themselves, and a value that is appended is left out.
+type HeaderPlugin struct {
+	set    map[string]string
+	append map[string]string
+	rename map[string]string
+	remove []string
+}
+
+// fills in a header value; ok is false if one of the variables is empty
+func (p *HeaderPlugin) interpolate(value string, ctx *apiplexy.APIContext) (v string, ok bool) {
+	ok = true
+	v = headerVar.ReplaceAllStringFunc(value, func(v string) string {
+		s := p.variable(v[1:len(v)-1], ctx)
+		ok = ok && s != ""
+		return s
+	})
+	return v, ok
+}
+
+func (p *HeaderPlugin) variable(name string, ctx *apiplexy.APIContext) string {
+	if name == "client_ip" {
+		return ctx.ClientIP
+	}
+	k := ctx.Key
+	if k == nil {
+		return ""
+	}
+	switch name {
+	case "key.id":
+		return k.ID
+	case "key.owner":
+		return k.Owner
+	case "key.type":
+		return k.Type
+	case "key.quota":
+		return k.Quota
+	case "key.realm":
+		return k.Realm
+	}
+	if d, ok := k.Data[strings.TrimPrefix(name, "key.data.")]; ok && d != nil {
+		return fmt.Sprint(d)
+	}
+	return ""
+}
+
+func (p *HeaderPlugin) transform(h http.Header, ctx *apiplexy.APIContext) {
+	for _, name := range p.remove {
+		h.Del(name)
+	}
+	for from, to := range p.rename {
+		if vv, ok := h[http.CanonicalHeaderKey(from)]; ok {
+			h.Del(from)
+			h[http.CanonicalHeaderKey(to)] = vv
+		}
+	}
+	for name, value := range p.set {
+		if v, ok := p.interpolate(value, ctx); ok {
+			h.Set(name, v)
+		} else {
+			h.Del(name)
+		}
+	}
+	for name, value := range p.append {
+		if v, ok := p.interpolate(value, ctx); ok {
+			h.Add(name, v)
+		}
+	}
+}
+
+func (p *HeaderPlugin) PreUpstream(req *http.Request, ctx *apiplexy.APIContext) error {
+	p.transform(req.Header, ctx)
+	return nil
+}
+
+func (p *HeaderPlugin) PostUpstream(req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
+	p.transform(res.Header, ctx)
+	return nil
+}
+
+func (p *HeaderPlugin) DefaultConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"set":    map[interface{}]interface{}{},
+		"append": map[interface{}]interface{}{},
+		"rename": map[interface{}]interface{}{},
+		"remove": []interface{}{},
+	}
+}
+
+// reads a header name -> value map from the configuration
+func headerMap(config map[string]interface{}, field string) (map[string]string, error) {
+	m := make(map[string]string)
+	for k, v := range config[field].(map[interface{}]interface{}) {
+		ks, kok := k.(string)
+		vs, vok := v.(string)
+		if !kok || !vok {
+			return nil, fmt.Errorf("Field '%s': header names and values should be strings.", field)
+		}
+		for _, hv := range headerVar.FindAllStringSubmatch(vs, -1) {
+			switch name := hv[1]; {
+			case name == "client_ip", name == "key.id", name == "key.owner", name == "key.type",
+				name == "key.quota", name == "key.realm":
+			case strings.HasPrefix(name, "key.data.") && len(name) > len("key.data."):
+			default:
+				return nil, fmt.Errorf("Field '%s': unknown variable {%s} in header '%s'.", field, name, ks)
+			}
+		}
+		m[ks] = vs
+	}
+	return m, nil
+}
+
+func (p *HeaderPlugin) Configure(config map[string]interface{}) error {
+	var err error
+	if p.set, err = headerMap(config, "set"); err != nil {
+		return err
+	}
+	if p.append, err = headerMap(config, "append"); err != nil {
+		return err
+	}
+	if p.rename, err = headerMap(config, "rename"); err != nil {
+		return err
+	}
+	for _, to := range p.rename {
+		if headerVar.MatchString(to) {
+			return fmt.Errorf("Field 'rename': header names can't use variables.")
+		}
+	}
+	p.remove = []string{}
+	for _, r := range config["remove"].([]interface{}) {
+		name, ok := r.(string)
+		if !ok {
+			return fmt.Errorf("Field 'remove': header names should be strings.")
+		}
+		p.remove = append(p.remove, name)
+	}
+	return nil
+}
+
+func init() {
+	apiplexy.RegisterPlugin(
+		"headers",
+		"Set, append, rename or remove request and response headers.",
+		"https://github.com/12foo/apiplexy/tree/master/misc/headers.md",
+		HeaderPlugin{},
+	)
+}
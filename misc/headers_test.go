@@ -0,0 +1,80 @@
+package misc
+
+import (
+	"github.com/12foo/apiplexy"
+	"net/http"
+	"testing"
+)
+
+func headerPlugin(t *testing.T, config map[string]interface{}) *HeaderPlugin {
+	p := &HeaderPlugin{}
+	for k, v := range p.DefaultConfig() {
+		if _, ok := config[k]; !ok {
+			config[k] = v
+		}
+	}
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("Configure failed: %s", err.Error())
+	}
+	return p
+}
+
+func TestHeaderTransform(t *testing.T) {
+	p := headerPlugin(t, map[string]interface{}{
+		"set": map[interface{}]interface{}{
+			"X-Consumer": "{key.owner}/{key.id}",
+			"X-Plan":     "{key.data.plan}",
+			"X-Real-IP":  "{client_ip}",
+		},
+		"append": map[interface{}]interface{}{"Via": "apiplexy"},
+		"rename": map[interface{}]interface{}{"X-Old": "X-New"},
+		"remove": []interface{}{"Cookie"},
+	})
+	req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+	req.Header.Set("Cookie", "a=b")
+	req.Header.Set("X-Old", "value")
+	req.Header.Set("Via", "proxy")
+	ctx := &apiplexy.APIContext{
+		ClientIP: "10.0.0.1",
+		Key:      &apiplexy.Key{ID: "k1", Owner: "alice", Data: map[string]interface{}{"plan": "gold"}},
+	}
+	p.PreUpstream(req, ctx)
+
+	for name, want := range map[string]string{
+		"X-Consumer": "alice/k1",
+		"X-Plan":     "gold",
+		"X-Real-IP":  "10.0.0.1",
+		"X-New":      "value",
+		"X-Old":      "",
+		"Cookie":     "",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("Expected %s to be '%s', got '%s'.", name, want, got)
+		}
+	}
+	if via := req.Header["Via"]; len(via) != 2 || via[1] != "apiplexy" {
+		t.Errorf("Expected Via to be appended to, got %v.", via)
+	}
+
+	// keyless requests get no key headers at all, not even ones the client sent
+	keyless, _ := http.NewRequest("GET", "http://gateway/x", nil)
+	keyless.Header.Set("X-Consumer", "mallory/forged")
+	p.PreUpstream(keyless, &apiplexy.APIContext{ClientIP: "10.0.0.2"})
+	if _, ok := keyless.Header["X-Consumer"]; ok {
+		t.Errorf("Expected no X-Consumer header without a key, got '%s'.", keyless.Header.Get("X-Consumer"))
+	}
+	res := &http.Response{Header: http.Header{}}
+	p.PostUpstream(req, res, &apiplexy.APIContext{ClientIP: "10.0.0.2"})
+	if got := res.Header.Get("X-Real-IP"); got != "10.0.0.2" {
+		t.Errorf("Expected X-Real-IP on the response to be '10.0.0.2', got '%s'.", got)
+	}
+}
+
+func TestHeaderConfig(t *testing.T) {
+	p := &HeaderPlugin{}
+	config := p.DefaultConfig()
+	config["set"] = map[interface{}]interface{}{"X-Secret": "{key.secret}"}
+	if err := p.Configure(config); err == nil {
+		t.Errorf("Expected unknown variables to be rejected.")
+	}
+}
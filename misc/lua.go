@@ -5,7 +5,6 @@ import (
 	"github.com/12foo/apiplexy"
 	"github.com/aarzilli/golua/lua"
 	"github.com/fatih/structs"
-	"net"
 	"net/http"
 	"strings"
 )
@@ -76,13 +75,6 @@ func popMap(L *lua.State) map[string]interface{} {
 }
 
 func (p *LuaPlugin) prepContext(L *lua.State, req *http.Request, ctx *apiplexy.APIContext) {
-	var clientIP string
-	if req.Header.Get("X-Forwarded-For") != "" {
-		clientIP = req.Header.Get("X-Forwarded-For")
-	} else {
-		clientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
-	}
-
 	headers := make(map[string]interface{}, len(req.Header))
 	for k, vs := range req.Header {
 		headers[k] = strings.Join(vs, " ")
@@ -91,7 +83,7 @@ func (p *LuaPlugin) prepContext(L *lua.State, req *http.Request, ctx *apiplexy.A
 	request := map[string]interface{}{
 		"path":     req.URL.Path,
 		"method":   req.Method,
-		"ip":       clientIP,
+		"ip":       ctx.ClientIP,
 		"referrer": req.Referer(),
 		"browser":  req.UserAgent(),
 		"headers":  headers,
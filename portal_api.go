@@ -249,6 +249,13 @@ func (p *portalAPI) deleteKey(email string, res http.ResponseWriter, req *http.R
 		abort(res, 500, "Could not delete key: %s", err.Error())
 		return
 	}
+	// the key must stop working right away, not when its cache entry runs out
+	rd := p.a.redis.Get()
+	defer rd.Close()
+	if err := p.a.revokeKey(rd, r.KID); err != nil {
+		abort(res, 500, "The key was deleted, but may keep working for a while: %s", err.Error())
+		return
+	}
 	msg := struct {
 		Deleted string `json:"deleted"`
 	}{Deleted: r.KID}
@@ -343,7 +350,7 @@ func (ap *apiplex) buildPortalAPI() (*portalAPI, error) {
 
 	availKeytypes := make(map[string]KeyType)
 	keyPlugins := make(map[string]AuthPlugin)
-	for _, authplug := range ap.auth {
+	for _, authplug := range ap.authPlugins() {
 		for _, kt := range authplug.AvailableTypes() {
 			availKeytypes[kt.Name] = kt
 			keyPlugins[kt.Name] = authplug
@@ -0,0 +1,183 @@
+package apiplexy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// A pluginSet keeps track of the plugins built for an apiplex, by their
+// configuration, so a reload can hand unchanged plugins over to the next apiplex.
+type pluginSet struct {
+	configured map[string][]interface{}
+	lifecycle  []LifecyclePlugin
+	// lifecycle plugins that were newly built and still have to be started
+	fresh []LifecyclePlugin
+}
+
+func newPluginSet() *pluginSet {
+	return &pluginSet{configured: make(map[string][]interface{})}
+}
+
+// identifies a plugin by what it's used as, its name and its configuration
+func pluginKey(pluginType reflect.Type, config apiplexPluginConfig) string {
+	return fmt.Sprintf("%s|%s|%v", pluginType.Name(), config.Plugin, config.Config)
+}
+
+func (ps *pluginSet) add(key string, plugin interface{}, fresh bool) {
+	ps.configured[key] = append(ps.configured[key], plugin)
+	if lp, ok := plugin.(LifecyclePlugin); ok {
+		ps.lifecycle = append(ps.lifecycle, lp)
+		if fresh {
+			ps.fresh = append(ps.fresh, lp)
+		}
+	}
+}
+
+func (ps *pluginSet) has(plugin LifecyclePlugin) bool {
+	for _, lp := range ps.lifecycle {
+		if lp == plugin {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts a request as being served by the apiplex. Fails once the apiplex is
+// retiring; the request has to go to its successor then.
+func (ap *apiplex) enter() bool {
+	ap.retireLock.RLock()
+	defer ap.retireLock.RUnlock()
+	if ap.retiring {
+		return false
+	}
+	ap.inflight.Add(1)
+	return true
+}
+
+func (ap *apiplex) leave() {
+	ap.inflight.Done()
+}
+
+// waits for wg, but no longer than ctx allows
+func drain(ctx context.Context, wg *sync.WaitGroup, what string) {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Gave up waiting for %s to finish.\n", what)
+	}
+}
+
+// Takes an apiplex out of service once its requests are done: waits for the
+// requests in flight, stops its health checks, waits for its logging to finish
+// and stops the plugins that next (if any) hasn't taken over. The waiting all
+// comes out of one deadline, set by ctx.
+func (ap *apiplex) retire(ctx context.Context, next *apiplex) {
+	ap.retireLock.Lock()
+	ap.retiring = true
+	ap.retireLock.Unlock()
+	drain(ctx, &ap.inflight, "requests in flight")
+	close(ap.stopHealth)
+	// let logging goroutines finish, so their data reaches the plugins before they stop
+	drain(ctx, &ap.pendingLogs, "request logging")
+	if ap.tracer != nil {
+		ap.tracer.exporter.shutdown()
+	}
+	for _, st := range ap.plugins.lifecycle {
+		if next != nil && next.plugins.has(st) {
+			continue
+		}
+		err := st.Stop()
+		if err != nil {
+			log.Printf("Error stopping plugin. %s\n", err.Error())
+		}
+	}
+	ap.redis.Close()
+}
+
+type gatewayState struct {
+	ap *apiplex
+}
+
+// The gateway serves every request with whatever apiplex is current at the time.
+type gateway struct {
+	current atomic.Value
+	reload  sync.Mutex
+}
+
+func (g *gateway) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	for {
+		ap := g.current.Load().(*gatewayState).ap
+		if ap.enter() {
+			defer ap.leave()
+			ap.vhostFor(req).mux.ServeHTTP(res, req)
+			return
+		}
+		// a retiring apiplex has been replaced already, unless the gateway is shutting down
+		if g.current.Load().(*gatewayState).ap == ap {
+			ap.error(503, Abort(503, "The gateway is shutting down.").WithCode("unavailable"), res, &APIContext{})
+			return
+		}
+	}
+}
+
+// Metrics serves the metrics of whatever apiplex is current.
+func (g *gateway) Metrics(res http.ResponseWriter, req *http.Request) {
+	g.current.Load().(*gatewayState).ap.Metrics(res, req)
+}
+
+// Reload builds a new apiplex from the configuration and swaps it in. Routes,
+// quotas and plugin chains all change at once; requests that are already running
+// finish on the old configuration, which is only torn down once they're done (or
+// the drain timeout is up). Plugins whose configuration is unchanged carry
+// on without being restarted. Listener settings (port, TLS) only change with a
+// restart.
+func (g *gateway) Reload(config ApiplexConfig) error {
+	g.reload.Lock()
+	defer g.reload.Unlock()
+
+	var old *gatewayState
+	if cur, ok := g.current.Load().(*gatewayState); ok {
+		old = cur
+	}
+	var previous *apiplex
+	if old != nil {
+		previous = old.ap
+	}
+
+	ap, err := buildApiplex(config, previous)
+	if err != nil {
+		return err
+	}
+	for _, vh := range ap.vhosts {
+		vh.mux, err = buildMux(ap, vh, config)
+		if err != nil {
+			// never served a request, so there's nothing to wait for
+			ap.retire(context.Background(), previous)
+			return err
+		}
+	}
+	g.current.Store(&gatewayState{ap: ap})
+
+	if old != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), old.ap.drainTimeout)
+			defer cancel()
+			old.ap.retire(ctx, ap)
+		}()
+	}
+	return nil
+}
+
+func (g *gateway) Shutdown(ctx context.Context) {
+	g.current.Load().(*gatewayState).ap.Shutdown(ctx)
+}
@@ -0,0 +1,149 @@
+package apiplexy
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type reloadTestPlugin struct {
+	target string
+}
+
+func (p *reloadTestPlugin) DefaultConfig() map[string]interface{} {
+	return map[string]interface{}{"target": "default"}
+}
+
+func (p *reloadTestPlugin) Configure(config map[string]interface{}) error {
+	p.target = config["target"].(string)
+	return nil
+}
+
+func (p *reloadTestPlugin) Log(req *http.Request, res *http.Response, ctx *APIContext) error {
+	return nil
+}
+
+func (p *reloadTestPlugin) Start(report func(error)) error { return nil }
+func (p *reloadTestPlugin) Stop() error                    { return nil }
+
+func TestPluginReuse(t *testing.T) {
+	RegisterPlugin("reload-test", "Plugin for reload tests.", "", reloadTestPlugin{})
+	loggingType := reflect.TypeOf((*LoggingPlugin)(nil)).Elem()
+	config := func(target string) apiplexPluginConfig {
+		return apiplexPluginConfig{Plugin: "reload-test", Config: map[string]interface{}{"target": target}}
+	}
+
+	first := newPluginSet()
+	chain, err := buildPlugins([]apiplexPluginConfig{config("a"), config("b")}, loggingType, first, nil)
+
+	Convey("Newly built lifecycle plugins should need starting", t, func() {
+		So(err, ShouldBeNil)
+		So(len(first.fresh), ShouldEqual, 2)
+	})
+
+	Convey("Plugins with unchanged configuration should be taken over", t, func() {
+		reusable := make(map[string][]interface{})
+		for k, v := range first.configured {
+			reusable[k] = v
+		}
+		second := newPluginSet()
+		next, err := buildPlugins([]apiplexPluginConfig{config("a"), config("c")}, loggingType, second, reusable)
+		So(err, ShouldBeNil)
+		So(next[0] == chain[0], ShouldBeTrue)
+		So(next[1] == chain[1], ShouldBeFalse)
+		So(next[1].(*reloadTestPlugin).target, ShouldEqual, "c")
+		So(len(second.fresh), ShouldEqual, 1)
+		So(second.has(chain[0].(LifecyclePlugin)), ShouldBeTrue)
+		So(second.has(chain[1].(LifecyclePlugin)), ShouldBeFalse)
+	})
+}
+
+type stopRecorder chan bool
+
+func (s stopRecorder) Start(report func(error)) error { return nil }
+func (s stopRecorder) Stop() error {
+	close(s)
+	return nil
+}
+
+// an apiplex with just enough in it to be retired
+func retirableApiplex() (*apiplex, stopRecorder) {
+	ap := &apiplex{
+		stopHealth:   make(chan bool),
+		drainTimeout: 5 * time.Second,
+		plugins:      newPluginSet(),
+		redis:        &redis.Pool{Dial: func() (redis.Conn, error) { return memoryRedis{}, nil }},
+	}
+	stopped := make(stopRecorder)
+	ap.plugins.add("stop-recorder", stopped, true)
+	return ap, stopped
+}
+
+func TestRetire(t *testing.T) {
+	Convey("A replaced apiplex should wait for its requests in flight", t, func() {
+		old, stopped := retirableApiplex()
+		next, _ := retirableApiplex()
+		So(old.enter(), ShouldBeTrue)
+		retired := make(chan bool)
+		go func() {
+			old.retire(context.Background(), next)
+			close(retired)
+		}()
+
+		select {
+		case <-stopped:
+			t.Error("Plugins were stopped while a request was in flight.")
+		case <-time.After(50 * time.Millisecond):
+		}
+		So(old.enter(), ShouldBeFalse)
+
+		old.leave()
+		select {
+		case <-retired:
+		case <-time.After(time.Second):
+			t.Error("Retiring didn't finish after the request was done.")
+		}
+		_, open := <-stopped
+		So(open, ShouldBeFalse)
+	})
+
+	Convey("Waiting for requests and logging should give up after one deadline", t, func() {
+		old, stopped := retirableApiplex()
+		So(old.enter(), ShouldBeTrue)
+		old.pendingLogs.Add(1)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		old.retire(ctx, nil)
+		So(time.Since(start), ShouldBeLessThan, 190*time.Millisecond)
+		_, open := <-stopped
+		So(open, ShouldBeFalse)
+	})
+
+	Convey("A failed reload should keep the old configuration", t, func() {
+		old, _ := retirableApiplex()
+		g := &gateway{}
+		g.current.Store(&gatewayState{ap: old})
+		// no default quota
+		So(g.Reload(ApiplexConfig{}), ShouldNotBeNil)
+		So(g.current.Load().(*gatewayState).ap == old, ShouldBeTrue)
+		So(old.enter(), ShouldBeTrue)
+		old.leave()
+	})
+
+	Convey("A gateway that has shut down should turn requests away", t, func() {
+		old, _ := retirableApiplex()
+		g := &gateway{}
+		g.current.Store(&gatewayState{ap: old})
+		g.Shutdown(context.Background())
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		g.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 503)
+	})
+}
@@ -0,0 +1,43 @@
+package apiplexy
+
+import (
+	"fmt"
+	"github.com/dchest/uniuri"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Request IDs from clients are taken as they are if they look harmless enough to
+// end up in logs, headers and emails.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/+=@-]{1,128}$`)
+
+// the header request IDs are taken from and passed on in; "off" switches
+// request IDs off altogether
+func requestIDHeader(configured string) string {
+	switch {
+	case configured == "":
+		return "X-Request-Id"
+	case strings.EqualFold(configured, "off"):
+		return ""
+	}
+	return http.CanonicalHeaderKey(configured)
+}
+
+// the ID of a request: the one the client (or a proxy in front of apiplexy) sent
+// along, or a new one
+func (ap *apiplex) requestID(req *http.Request) string {
+	if id := req.Header.Get(ap.requestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	return uniuri.NewLen(20)
+}
+
+// like reportError, but says which request the error happened in
+func (ap *apiplex) reportRequestError(err error, ctx *APIContext) {
+	if ctx.RequestID == "" {
+		ap.reportError(err)
+		return
+	}
+	ap.reportError(fmt.Errorf("%s (request ID %s)", err.Error(), ctx.RequestID))
+}
@@ -0,0 +1,61 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	ap := &apiplex{requestIDHeader: "X-Request-Id"}
+
+	Convey("Request IDs from the client should be kept", t, func() {
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		req.Header.Set("X-Request-ID", "abc-123")
+		So(ap.requestID(req), ShouldEqual, "abc-123")
+	})
+
+	Convey("Missing or odd-looking request IDs should be replaced", t, func() {
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		So(ap.requestID(req), ShouldHaveLength, 20)
+		req.Header.Set("X-Request-ID", "<script>alert(1)</script>")
+		So(ap.requestID(req), ShouldNotEqual, "<script>alert(1)</script>")
+		So(ap.requestID(req), ShouldNotEqual, ap.requestID(req))
+	})
+
+	Convey("The request ID header should be configurable, or switched off", t, func() {
+		So(requestIDHeader(""), ShouldEqual, "X-Request-Id")
+		So(requestIDHeader("x-correlation-id"), ShouldEqual, "X-Correlation-Id")
+		So(requestIDHeader("off"), ShouldEqual, "")
+		So(requestIDHeader("Off"), ShouldEqual, "")
+	})
+
+	Convey("Requests shouldn't get an ID with request IDs switched off", t, func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Request-Id", "from-backend")
+			w.Write([]byte(r.Header.Get("X-Request-Id")))
+		}))
+		defer backend.Close()
+		gateway := proxyTo(backend.URL)
+		defer gateway.Close()
+
+		rs, err := http.Get(gateway.URL + "/x")
+		So(err, ShouldBeNil)
+		body, _ := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		So(string(body), ShouldEqual, "")
+		So(rs.Header.Get("X-Request-Id"), ShouldEqual, "from-backend")
+	})
+
+	Convey("Error bodies should carry the request ID", t, func() {
+		w := httptest.NewRecorder()
+		ap.error(403, Abort(403, "Access denied."), w, &APIContext{RequestID: "abc-123"})
+		var body map[string]interface{}
+		So(json.Unmarshal(w.Body.Bytes(), &body), ShouldBeNil)
+		So(body["detail"], ShouldEqual, "Access denied.")
+		So(body["request_id"], ShouldEqual, "abc-123")
+	})
+}
@@ -0,0 +1,190 @@
+package apiplexy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Only these methods are retried unless the route configuration says otherwise.
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE", "TRACE"}
+
+// Kinds of upstream errors that a retry policy can be set to retry on.
+const (
+	retryConnect = "connect"
+	retryTimeout = "timeout"
+	retryReset   = "reset"
+)
+
+// returned for an attempt that never left the gateway, because the chosen
+// backend's circuit breaker is open
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// A retryPolicy decides whether a failed upstream request should be tried again
+// on another backend of the same API path.
+type retryPolicy struct {
+	attempts   int
+	errors     map[string]bool
+	statuses   map[int]bool
+	methods    map[string]bool
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newRetryPolicy(api string, config apiplexConfigRetry) (*retryPolicy, error) {
+	rp := &retryPolicy{
+		attempts:   config.Attempts,
+		errors:     make(map[string]bool),
+		statuses:   make(map[int]bool),
+		methods:    make(map[string]bool),
+		backoff:    time.Duration(config.Backoff) * time.Millisecond,
+		maxBackoff: time.Duration(config.MaxBackoff) * time.Millisecond,
+	}
+	if rp.attempts <= 0 {
+		rp.attempts = 3
+	}
+	if config.Errors == nil {
+		config.Errors = []string{retryConnect, retryTimeout}
+	}
+	for _, e := range config.Errors {
+		switch e {
+		case retryConnect, retryTimeout, retryReset:
+			rp.errors[e] = true
+		default:
+			return nil, fmt.Errorf("Unknown error kind '%s' in retry policy for API path '%s'. Use %s, %s or %s.", e, api, retryConnect, retryTimeout, retryReset)
+		}
+	}
+	if config.Statuses == nil {
+		config.Statuses = []int{502, 503, 504}
+	}
+	for _, s := range config.Statuses {
+		rp.statuses[s] = true
+	}
+	if config.Methods == nil {
+		config.Methods = idempotentMethods
+	}
+	for _, m := range config.Methods {
+		rp.methods[strings.ToUpper(m)] = true
+	}
+	if rp.maxBackoff <= 0 {
+		rp.maxBackoff = 2 * time.Second
+	}
+	return rp, nil
+}
+
+// sorts an upstream error into one of the retryable kinds (or "")
+func errorKind(err error) string {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return retryTimeout
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		if oe.Op == "dial" {
+			return retryConnect
+		}
+		return retryReset
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF || strings.Contains(err.Error(), "connection reset") {
+		return retryReset
+	}
+	return ""
+}
+
+func (rp *retryPolicy) shouldRetry(urs *http.Response, err error) bool {
+	if err == errBreakerOpen {
+		// nothing was sent, so trying another backend is always safe
+		return true
+	}
+	if err != nil {
+		return rp.errors[errorKind(err)]
+	}
+	return rp.statuses[urs.StatusCode]
+}
+
+// exponential backoff before the given attempt
+func (rp *retryPolicy) delay(attempt int) time.Duration {
+	d := rp.backoff
+	for i := 2; i < attempt && d < rp.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	return d
+}
+
+// Sends a single attempt to ctx.Upstream, going through its circuit breaker. If a
+// response comes back, the upstream stays acquired and the caller has to release it.
+func (ap *apiplex) attemptUpstream(req *http.Request, ctx *APIContext, body []byte) (*http.Response, error) {
+	if !ap.admit(req, ctx) {
+		return nil, errBreakerOpen
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	ctx.Upstream.acquire()
+	urs, err := ap.upstreamRequest(req, ctx)
+	ok := err == nil && urs.StatusCode < 500
+	ap.recordOutcome(req, urs, ctx, ok)
+	if !ok {
+		stats.upstreamErrors.inc(ctx.VHost, ctx.APIPath, ctx.Upstream.Address.String())
+	}
+	if err != nil {
+		ctx.Upstream.release()
+		return nil, err
+	}
+	return urs, nil
+}
+
+// Sends a request upstream, retrying on other backends of the API path as allowed
+// by the route's retry policy. Every retry goes to a backend that hasn't been tried
+// yet. The number of attempts ends up in the request log.
+func (ap *apiplex) tryUpstreams(req *http.Request, ctx *APIContext, pool *upstreamPool) (*http.Response, error) {
+	policy := pool.retry
+	attempts := 1
+	if policy != nil && policy.methods[req.Method] {
+		attempts = policy.attempts
+	}
+
+	// the request body has to be replayable if we might send it more than once
+	var body []byte
+	if attempts > 1 && req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	tried := make(map[*APIUpstream]bool, attempts)
+	for attempt := 1; ; attempt++ {
+		tried[ctx.Upstream] = true
+		ctx.Log["attempts"] = attempt
+		urs, err := ap.attemptUpstream(req, ctx, body)
+
+		var next *APIUpstream
+		if attempt < attempts && policy.shouldRetry(urs, err) {
+			next = pool.pickExcept(tried)
+		}
+		if next == nil {
+			return urs, err
+		}
+
+		if urs != nil {
+			urs.Body.Close()
+			ctx.Upstream.release()
+		}
+		time.Sleep(policy.delay(attempt + 1))
+		ctx.Upstream = next
+	}
+}
@@ -0,0 +1,60 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func testUpstream(address string) *APIUpstream {
+	u, _ := url.Parse(address)
+	return &APIUpstream{Client: &http.Client{}, Address: u, Weight: 1}
+}
+
+// an address where nobody is listening
+func refusingAddress() string {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr + "/"
+}
+
+func TestRetries(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		res.Write([]byte("OK:" + string(b)))
+	}))
+	defer backend.Close()
+
+	ap := &apiplex{}
+	policy, _ := newRetryPolicy("/", apiplexConfigRetry{Methods: []string{"GET", "POST"}})
+	dead := testUpstream(refusingAddress())
+	pool := &upstreamPool{
+		strategy:  strategyRoundRobin,
+		upstreams: []*APIUpstream{dead, testUpstream(backend.URL + "/")},
+		retry:     policy,
+	}
+
+	Convey("Refused connections should fail over to another backend", t, func() {
+		req, _ := http.NewRequest("POST", "http://gateway/x", strings.NewReader("body"))
+		ctx := &APIContext{APIPath: "/", Upstream: dead, Log: map[string]interface{}{}}
+		urs, err := ap.tryUpstreams(req, ctx, pool)
+		So(err, ShouldBeNil)
+		b, _ := ioutil.ReadAll(urs.Body)
+		So(string(b), ShouldEqual, "OK:body")
+		So(ctx.Log["attempts"], ShouldEqual, 2)
+	})
+
+	Convey("Methods outside the policy should not be retried", t, func() {
+		req, _ := http.NewRequest("PATCH", "http://gateway/x", nil)
+		ctx := &APIContext{APIPath: "/", Upstream: dead, Log: map[string]interface{}{}}
+		_, err := ap.tryUpstreams(req, ctx, pool)
+		So(err, ShouldNotBeNil)
+		So(ctx.Log["attempts"], ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,252 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// matches {name} (one path segment) and {name*} (the rest of the path) in templates
+var templateVar = regexp.MustCompile(`\{(\w+)(\*?)\}`)
+
+// A rewriteRule sends requests whose path matches to a different upstream path,
+// optionally adding query parameters and headers. Variables captured by the match
+// can be used in all of them as {name}.
+type rewriteRule struct {
+	source  string
+	match   *regexp.Regexp
+	path    string
+	query   map[string]string
+	headers map[string]string
+}
+
+// turns a path template like /v1/users/{id} into an anchored regex
+func templateRegex(tmpl string) (*regexp.Regexp, error) {
+	expr := "^"
+	last := 0
+	for _, m := range templateVar.FindAllStringSubmatchIndex(tmpl, -1) {
+		expr += regexp.QuoteMeta(tmpl[last:m[0]])
+		name := tmpl[m[2]:m[3]]
+		if m[5] > m[4] {
+			expr += "(?P<" + name + ">.*)"
+		} else {
+			expr += "(?P<" + name + ">[^/]+)"
+		}
+		last = m[1]
+	}
+	expr += regexp.QuoteMeta(tmpl[last:]) + "$"
+	return regexp.Compile(expr)
+}
+
+// checks that a template only uses variables the match captures
+func checkTemplate(tmpl string, vars map[string]bool) error {
+	for _, m := range templateVar.FindAllStringSubmatch(tmpl, -1) {
+		if !vars[m[1]] {
+			return fmt.Errorf("'%s' uses {%s}, which the rule doesn't capture.", tmpl, m[1])
+		}
+	}
+	return nil
+}
+
+func newRewriteRule(api string, config apiplexConfigRewrite) (*rewriteRule, error) {
+	rr := &rewriteRule{path: config.Path, query: config.Query, headers: config.Headers}
+	var err error
+	switch {
+	case config.Match != "" && config.Regex != "":
+		return nil, fmt.Errorf("Rewrite rule for API path '%s' has both match and regex. Use one.", api)
+	case config.Match != "":
+		rr.source = config.Match
+		rr.match, err = templateRegex(config.Match)
+	case config.Regex != "":
+		rr.source = config.Regex
+		rr.match, err = regexp.Compile(config.Regex)
+	default:
+		return nil, fmt.Errorf("Rewrite rule for API path '%s' needs a match or a regex.", api)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rewrite rule '%s' for API path '%s': %s", rr.source, api, err.Error())
+	}
+
+	vars := make(map[string]bool)
+	for i, name := range rr.match.SubexpNames() {
+		vars[fmt.Sprintf("%d", i)] = true
+		if name != "" {
+			vars[name] = true
+		}
+	}
+	templates := []string{rr.path}
+	for k, v := range rr.query {
+		templates = append(templates, k, v)
+	}
+	for _, v := range rr.headers {
+		templates = append(templates, v)
+	}
+	for _, t := range templates {
+		if err := checkTemplate(t, vars); err != nil {
+			return nil, fmt.Errorf("Rewrite rule '%s' for API path '%s': %s", rr.source, api, err.Error())
+		}
+	}
+	return rr, nil
+}
+
+func newRewriteRules(api string, config []apiplexConfigRewrite) ([]*rewriteRule, error) {
+	rules := make([]*rewriteRule, 0, len(config))
+	for _, rc := range config {
+		rr, err := newRewriteRule(api, rc)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rr)
+	}
+	return rules, nil
+}
+
+// the variables captured from a path, or nil if the rule doesn't match
+func (rr *rewriteRule) capture(path string) map[string]string {
+	m := rr.match.FindStringSubmatch(path)
+	if m == nil {
+		return nil
+	}
+	vars := make(map[string]string, len(m))
+	for i, name := range rr.match.SubexpNames() {
+		vars[fmt.Sprintf("%d", i)] = m[i]
+		if name != "" {
+			vars[name] = m[i]
+		}
+	}
+	return vars
+}
+
+func expand(tmpl string, vars map[string]string) string {
+	return templateVar.ReplaceAllStringFunc(tmpl, func(v string) string {
+		return vars[templateVar.FindStringSubmatch(v)[1]]
+	})
+}
+
+// puts a path below an upstream's base path
+func joinPaths(base, rest string) string {
+	if rest == "" || rest == "/" {
+		if base == "" {
+			return "/"
+		}
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(rest, "/")
+}
+
+// the first rule that matches a path, with the variables it captured
+func matchRewrite(rules []*rewriteRule, path string) (*rewriteRule, map[string]string) {
+	for _, rr := range rules {
+		if vars := rr.capture(path); vars != nil {
+			return rr, vars
+		}
+	}
+	return nil, nil
+}
+
+// Points an upstream request at its backend's path. The first rewrite rule that
+// matches the request path decides the upstream path (below the backend's base
+// path), and adds its query parameters and headers. Without a matching rule, the
+// API prefix is swapped for the backend's base path.
+func rewriteUpstream(outreq *http.Request, rules []*rewriteRule, api string, base *url.URL) {
+	path := outreq.URL.Path
+	outreq.URL.RawPath = ""
+	rr, vars := matchRewrite(rules, path)
+	if rr == nil || rr.path == "" {
+		outreq.URL.Path = joinPaths(base.Path, stripPrefix(path, api))
+	} else {
+		outreq.URL.Path = joinPaths(base.Path, expand(rr.path, vars))
+	}
+	if rr == nil {
+		return
+	}
+	if len(rr.query) > 0 {
+		q := outreq.URL.Query()
+		for k, v := range rr.query {
+			q.Set(expand(k, vars), expand(v, vars))
+		}
+		outreq.URL.RawQuery = q.Encode()
+	}
+	for k, v := range rr.headers {
+		outreq.Header.Set(k, expand(v, vars))
+	}
+}
+
+// the part of a path below an API prefix
+func stripPrefix(path, api string) string {
+	prefix := ensureSlashes(api)
+	if prefix == "/" {
+		return path
+	}
+	return strings.TrimPrefix(path, prefix)
+}
+
+// A RewriteTrace shows what apiplexy would do with a request: which (virtual)
+// host and API path it goes to, which rewrite rule applies and what the request
+// to the backend looks like.
+type RewriteTrace struct {
+	VHost   string
+	APIPath string
+	Rule    string
+	URL     string
+	Header  http.Header
+}
+
+// TraceRewrite routes a request through a configuration without sending it
+// anywhere, to check routes and rewrite rules. Plugins are not run.
+func TraceRewrite(config ApiplexConfig, method, target string, header http.Header) (*RewriteTrace, error) {
+	// plugins and key policies don't take part in routing, and plugins
+	// shouldn't be started for this
+	strip := func(routes map[string]apiplexConfigRoute) map[string]apiplexConfigRoute {
+		stripped := make(map[string]apiplexConfigRoute, len(routes))
+		for api, r := range routes {
+			r.Plugins = nil
+			r.Keyless = nil
+			stripped[api] = r
+		}
+		return stripped
+	}
+	config.Serve.Routes = strip(config.Serve.Routes)
+	vhosts := make(map[string]apiplexConfigVHost, len(config.Serve.VHosts))
+	for name, vc := range config.Serve.VHosts {
+		vc.Routes = strip(vc.Routes)
+		vhosts[name] = vc
+	}
+	config.Serve.VHosts = vhosts
+
+	ap := &apiplex{chains: &pluginChains{}}
+	if err := ap.buildVirtualHosts(config, nil); err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(target, "://") {
+		target = "http://localhost" + ensureSlashes(target)
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+
+	vhost := ap.vhostFor(req)
+	route := vhost.router.match(req)
+	if route == nil {
+		return nil, fmt.Errorf("There is no API at '%s'.", req.URL.Path)
+	}
+	ctx := &APIContext{APIPath: route.api, VHost: vhost.name, Upstream: route.pool.upstreams[0]}
+	outreq := ap.prepareUpstream(req, ctx)
+	trace := &RewriteTrace{
+		VHost:   vhost.name,
+		APIPath: route.api,
+		URL:     outreq.URL.String(),
+		Header:  outreq.Header,
+	}
+	if rr, _ := matchRewrite(route.pool.rewrites, req.URL.Path); rr != nil {
+		trace.Rule = rr.source
+	}
+	return trace, nil
+}
@@ -0,0 +1,98 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func rewritten(rules []*rewriteRule, api, backend, target string) *http.Request {
+	req, _ := http.NewRequest("GET", target, nil)
+	base, _ := url.Parse(backend)
+	rewriteUpstream(req, rules, api, base)
+	return req
+}
+
+func TestRewrite(t *testing.T) {
+	Convey("Without rules, the API prefix should be swapped for the backend path", t, func() {
+		So(rewritten(nil, "/v1", "http://b/api", "http://gw/v1/users").URL.Path, ShouldEqual, "/api/users")
+		So(rewritten(nil, "/v1", "http://b/api/", "http://gw/v1/users").URL.Path, ShouldEqual, "/api/users")
+		So(rewritten(nil, "/v1", "http://b", "http://gw/v1/users").URL.Path, ShouldEqual, "/users")
+		So(rewritten(nil, "/", "http://b/", "http://gw/users").URL.Path, ShouldEqual, "/users")
+		So(rewritten(nil, "/v1", "http://b/api", "http://gw/v1").URL.Path, ShouldEqual, "/api")
+	})
+
+	Convey("Only the API prefix should be swapped when it appears again", t, func() {
+		So(rewritten(nil, "/v1", "http://b/api", "http://gw/v1/files/v1/x").URL.Path, ShouldEqual, "/api/files/v1/x")
+	})
+
+	Convey("Template rules should capture path segments", t, func() {
+		rules, err := newRewriteRules("/v1", []apiplexConfigRewrite{
+			{Match: "/v1/users/{id}", Path: "/internal/accounts/{id}"},
+			{Match: "/v1/files/{rest*}", Path: "/blobs/{rest}"},
+		})
+		So(err, ShouldBeNil)
+		So(rewritten(rules, "/v1", "http://b/", "http://gw/v1/users/42").URL.Path, ShouldEqual, "/internal/accounts/42")
+		So(rewritten(rules, "/v1", "http://b/svc", "http://gw/v1/files/a/b.txt").URL.Path, ShouldEqual, "/svc/blobs/a/b.txt")
+		// {id} is one segment only, so this falls through to the prefix swap
+		So(rewritten(rules, "/v1", "http://b/", "http://gw/v1/users/42/posts").URL.Path, ShouldEqual, "/users/42/posts")
+	})
+
+	Convey("Captured variables should be usable in query and headers", t, func() {
+		rules, err := newRewriteRules("/v1", []apiplexConfigRewrite{{
+			Regex:   `^/v1/(?P<org>\w+)/items/(\d+)$`,
+			Path:    "/items",
+			Query:   map[string]string{"item": "{2}"},
+			Headers: map[string]string{"X-Org": "{org}"},
+		}})
+		So(err, ShouldBeNil)
+		req := rewritten(rules, "/v1", "http://b/", "http://gw/v1/acme/items/7?page=2")
+		So(req.URL.Path, ShouldEqual, "/items")
+		So(req.URL.Query().Get("item"), ShouldEqual, "7")
+		So(req.URL.Query().Get("page"), ShouldEqual, "2")
+		So(req.Header.Get("X-Org"), ShouldEqual, "acme")
+	})
+
+	Convey("Invalid rules should be rejected", t, func() {
+		for _, rc := range []apiplexConfigRewrite{
+			{Path: "/x"},
+			{Match: "/a", Regex: "^/a$"},
+			{Regex: "^/a(", Path: "/x"},
+			{Match: "/users/{id}", Path: "/accounts/{user}"},
+			{Regex: "^/users/(\\d+)$", Headers: map[string]string{"X-User": "{2}"}},
+		} {
+			_, err := newRewriteRule("/v1", rc)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Traces should show where a request goes", t, func() {
+		config := ApiplexConfig{}
+		config.Serve.Backends = map[string][]string{"/v1": {"http://users.internal/"}}
+		config.Serve.Routes = map[string]apiplexConfigRoute{
+			"/v1": {Rewrite: []apiplexConfigRewrite{{Match: "/v1/users/{id}", Path: "/accounts/{id}", Headers: map[string]string{"X-User": "{id}"}}}},
+		}
+		trace, err := TraceRewrite(config, "get", "/v1/users/42", nil)
+		So(err, ShouldBeNil)
+		So(trace.APIPath, ShouldEqual, "/v1")
+		So(trace.Rule, ShouldEqual, "/v1/users/{id}")
+		So(trace.URL, ShouldEqual, "http://users.internal/accounts/42")
+		So(trace.Header.Get("X-User"), ShouldEqual, "42")
+
+		_, err = TraceRewrite(config, "GET", "/v2/users", nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Traces should work for keyless routes", t, func() {
+		keyless := true
+		config := ApiplexConfig{}
+		config.Quotas = map[string]apiplexQuota{"keyless": {Minutes: 5, MaxIP: 50}}
+		config.Serve.Backends = map[string][]string{"/public": {"http://public.internal/"}}
+		config.Serve.Routes = map[string]apiplexConfigRoute{"/public": {Keyless: &keyless}}
+		trace, err := TraceRewrite(config, "GET", "/public/status", nil)
+		So(err, ShouldBeNil)
+		So(trace.APIPath, ShouldEqual, "/public")
+		So(trace.URL, ShouldEqual, "http://public.internal/status")
+	})
+}
@@ -0,0 +1,210 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// An apiRoute connects an API path (plus optional method and host conditions)
+// to the pool of backends serving it.
+type apiRoute struct {
+	api     string
+	prefix  string
+	methods map[string]bool
+	hosts   map[string]bool
+	pool    *upstreamPool
+}
+
+// A router finds the API route for a request. Routes are kept sorted so the
+// longest, most specific prefix always wins, no matter in which order they
+// were configured.
+type router struct {
+	routes []*apiRoute
+}
+
+func newRoute(api string, config apiplexConfigRoute, pool *upstreamPool) *apiRoute {
+	r := &apiRoute{
+		api:    api,
+		prefix: ensureSlashes(api),
+		pool:   pool,
+	}
+	if len(config.Methods) > 0 {
+		r.methods = make(map[string]bool, len(config.Methods))
+		for _, m := range config.Methods {
+			r.methods[strings.ToUpper(strings.TrimSpace(m))] = true
+		}
+	}
+	if len(config.Hosts) > 0 {
+		r.hosts = make(map[string]bool, len(config.Hosts))
+		for _, h := range config.Hosts {
+			r.hosts[strings.ToLower(strings.TrimSpace(h))] = true
+		}
+	}
+	return r
+}
+
+// number of conditions on a route; routes with more conditions are tried first
+// if their prefixes are equally long.
+func (r *apiRoute) conditions() int {
+	c := 0
+	if r.methods != nil {
+		c++
+	}
+	if r.hosts != nil {
+		c++
+	}
+	return c
+}
+
+func newRouter(routes []*apiRoute) *router {
+	sort.Sort(byPrefix(routes))
+	return &router{routes: routes}
+}
+
+type byPrefix []*apiRoute
+
+func (s byPrefix) Len() int      { return len(s) }
+func (s byPrefix) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPrefix) Less(i, j int) bool {
+	if len(s[i].prefix) != len(s[j].prefix) {
+		return len(s[i].prefix) > len(s[j].prefix)
+	}
+	if s[i].conditions() != s[j].conditions() {
+		return s[i].conditions() > s[j].conditions()
+	}
+	return s[i].api < s[j].api
+}
+
+// prefixes only match on whole path segments, so /api doesn't catch /apiary
+func matchesPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func (r *apiRoute) matches(req *http.Request) bool {
+	if !matchesPrefix(req.URL.Path, r.prefix) {
+		return false
+	}
+	method := req.Method
+	if isPreflight(req) {
+		// preflights go where the request they ask about would go
+		method = strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+	}
+	if r.methods != nil && !r.methods[method] {
+		return false
+	}
+	if r.hosts != nil && !matchesHost(r.hosts, requestHost(req)) {
+		return false
+	}
+	return true
+}
+
+func matchesHost(hosts map[string]bool, host string) bool {
+	if hosts[host] {
+		return true
+	}
+	for pattern := range hosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the route for a request, or nil if there is none.
+func (rt *router) match(req *http.Request) *apiRoute {
+	for _, r := range rt.routes {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// do two routes accept at least one common request (ignoring the path)?
+func overlaps(a, b map[string]bool) bool {
+	if a == nil || b == nil {
+		return true
+	}
+	for k := range a {
+		if b[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteWarnings checks a configuration for routes that are ambiguous (two API
+// paths that accept the same requests) or shadowed (part of an API path is
+// taken over by a static path or the portal API). None of these stop apiplexy
+// from running, but they're almost always a mistake.
+func RouteWarnings(config ApiplexConfig) []string {
+	warnings := hostRouteWarnings(config.Serve.Backends, config.Serve.Routes, config.Serve.Static, config.Serve.PortalAPI)
+	names := make([]string, 0, len(config.Serve.VHosts))
+	for name := range config.Serve.VHosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vc := config.Serve.VHosts[name]
+		for _, w := range hostRouteWarnings(vc.Backends, vc.Routes, vc.Static, vc.PortalAPI) {
+			warnings = append(warnings, fmt.Sprintf("In virtual host '%s': %s", name, w))
+		}
+	}
+	return warnings
+}
+
+func hostRouteWarnings(backends map[string][]string, routeConfig map[string]apiplexConfigRoute, static map[string]string, portalAPI string) []string {
+	warnings := []string{}
+
+	routes := make([]*apiRoute, 0, len(backends))
+	for api := range backends {
+		routes = append(routes, newRoute(api, routeConfig[api], nil))
+	}
+	sort.Sort(byPrefix(routes))
+
+	for i, a := range routes {
+		for _, b := range routes[i+1:] {
+			if a.prefix == b.prefix && overlaps(a.methods, b.methods) && overlaps(a.hosts, b.hosts) {
+				warnings = append(warnings, fmt.Sprintf("API paths '%s' and '%s' are ambiguous: both match the same requests. '%s' will always win.", a.api, b.api, a.api))
+			}
+		}
+	}
+
+	mounts := map[string]string{}
+	for s := range static {
+		mounts[ensureSlashes(s)] = fmt.Sprintf("Static path '%s'", s)
+	}
+	if portalAPI != "" {
+		mounts[ensureSlashes(portalAPI)] = fmt.Sprintf("Portal API '%s'", portalAPI)
+	}
+	mountPaths := make([]string, 0, len(mounts))
+	for m := range mounts {
+		mountPaths = append(mountPaths, m)
+	}
+	sort.Strings(mountPaths)
+	for _, m := range mountPaths {
+		for _, r := range routes {
+			if m == r.prefix {
+				warnings = append(warnings, fmt.Sprintf("%s and API path '%s' are mounted at the same place.", mounts[m], r.api))
+			} else if m != "/" && matchesPrefix(m, r.prefix) {
+				warnings = append(warnings, fmt.Sprintf("%s shadows part of API path '%s'.", mounts[m], r.api))
+			}
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,76 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func testRouter(routes map[string]apiplexConfigRoute, apis ...string) *router {
+	rs := make([]*apiRoute, len(apis))
+	for i, api := range apis {
+		rs[i] = newRoute(api, routes[api], nil)
+	}
+	return newRouter(rs)
+}
+
+func matchedAPI(rt *router, method, url string) string {
+	req, _ := http.NewRequest(method, url, nil)
+	r := rt.match(req)
+	if r == nil {
+		return ""
+	}
+	return r.api
+}
+
+func TestRouting(t *testing.T) {
+	Convey("The longest prefix should always win", t, func() {
+		for i := 0; i < 20; i++ {
+			rt := testRouter(nil, "/api/", "/api/v2/", "/")
+			So(matchedAPI(rt, "GET", "http://example.com/api/v2/users"), ShouldEqual, "/api/v2/")
+			So(matchedAPI(rt, "GET", "http://example.com/api/v1/users"), ShouldEqual, "/api/")
+			So(matchedAPI(rt, "GET", "http://example.com/other"), ShouldEqual, "/")
+		}
+	})
+
+	Convey("Prefixes should only match whole path segments", t, func() {
+		rt := testRouter(nil, "/api")
+		So(matchedAPI(rt, "GET", "http://example.com/api"), ShouldEqual, "/api")
+		So(matchedAPI(rt, "GET", "http://example.com/api/x"), ShouldEqual, "/api")
+		So(matchedAPI(rt, "GET", "http://example.com/apiary"), ShouldEqual, "")
+	})
+
+	Convey("Method and host conditions should restrict routes", t, func() {
+		routes := map[string]apiplexConfigRoute{
+			"/api/": {Methods: []string{"get"}, Hosts: []string{"API.example.com"}},
+		}
+		rt := testRouter(routes, "/api/", "/")
+		So(matchedAPI(rt, "GET", "http://api.example.com:8080/api/x"), ShouldEqual, "/api/")
+		So(matchedAPI(rt, "POST", "http://api.example.com/api/x"), ShouldEqual, "/")
+		So(matchedAPI(rt, "GET", "http://other.example.com/api/x"), ShouldEqual, "/")
+	})
+}
+
+func TestRouteWarnings(t *testing.T) {
+	Convey("Duplicate API paths should be reported as ambiguous", t, func() {
+		config := ApiplexConfig{}
+		config.Serve.Backends = map[string][]string{
+			"/api":  {"http://a"},
+			"/api/": {"http://b"},
+		}
+		So(RouteWarnings(config), ShouldHaveLength, 1)
+
+		config.Serve.Routes = map[string]apiplexConfigRoute{
+			"/api":  {Methods: []string{"GET"}},
+			"/api/": {Methods: []string{"POST"}},
+		}
+		So(RouteWarnings(config), ShouldBeEmpty)
+	})
+
+	Convey("Static paths inside an API path should be reported as shadowing", t, func() {
+		config := ApiplexConfig{}
+		config.Serve.Backends = map[string][]string{"/api/": {"http://a"}}
+		config.Serve.Static = map[string]string{"/": "/srv/www", "/api/docs": "/srv/docs"}
+		So(RouteWarnings(config), ShouldHaveLength, 1)
+	})
+}
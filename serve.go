@@ -2,20 +2,25 @@ package apiplexy
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"gopkg.in/gomail.v2"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-// Hop-by-hop headers. These are removed when sent to the backend.
+// Hop-by-hop headers. These are removed when sent to the backend. (Upgrade requests
+// get their Connection and Upgrade headers put back in proxyUpgrade.)
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
 var hopHeaders = []string{
 	"Connection",
@@ -28,9 +33,8 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
-type processingError struct {
-	Error string `json:"error"`
-}
+// Upstream error bodies larger than this are cut off in alert emails.
+const maxReportedBody = 64 * 1024
 
 func (ap *apiplex) sendEmail(to string, subject string, contentType string, body string) {
 	m := gomail.NewMessage()
@@ -60,19 +64,17 @@ func (ap *apiplex) reportError(err error) {
 
 // Shortcut function to end requests prematurely. If called with an AbortRequest, will end request
 // nicely with an error message to the user. If called with any other error type, will throw a 500
-// and report the error through reporting.
-func (ap *apiplex) error(status int, err error, res http.ResponseWriter) {
-	switch e := err.(type) {
-	case AbortRequest:
-		res.WriteHeader(e.Status)
-		jsonError, _ := json.Marshal(&processingError{Error: e.Error()})
-		res.Write(jsonError)
-	default:
-		ap.reportError(e)
-		res.WriteHeader(status)
-		jsonError, _ := json.Marshal(&processingError{Error: e.Error()})
-		res.Write(jsonError)
+// and report the error through reporting. Either way, the client gets a problem+json body, or
+// whatever the route's error templates make of it.
+func (ap *apiplex) error(status int, err error, res http.ResponseWriter, ctx *APIContext) {
+	if _, ok := err.(AbortRequest); !ok {
+		ap.reportRequestError(err, ctx)
+	}
+	er := ctx.errors
+	if er == nil {
+		er = ap.errors
 	}
+	er.render(res, newProblem(status, err, ctx.RequestID))
 }
 
 // Authenticate a request: first, tries all AuthPlugins in order. The first one that Detect()s
@@ -86,24 +88,41 @@ func (ap *apiplex) error(status int, err error, res http.ResponseWriter) {
 //
 // If no key is detected in the request and keyless mode is enabled in the config (i.e. a "keyless"
 // quota is present), the request is marked as keyless and allowed to proceed against the
-// "keyless" quota.
-func (ap *apiplex) authenticateRequest(req *http.Request, rd redis.Conn, ctx *APIContext) error {
+// "keyless" quota. Routes can allow or forbid keyless requests for their API path with their
+// own keyless setting.
+func (ap *apiplex) authenticateRequest(req *http.Request, rd redis.Conn, ctx *APIContext, chains *pluginChains) error {
 	found := false
-	for _, auth := range ap.auth {
+	for _, auth := range chains.auth {
+		sp := ctx.trace.startSpan("auth.detect", spanInternal).set("apiplexy.plugin", pluginName(auth))
 		maybeKey, keyType, bits, err := auth.Detect(req, ctx)
+		sp.set("apiplexy.key_found", maybeKey != "").finish(err)
+		countPluginError("auth", auth, err)
 		if err != nil {
 			return err
 		}
 
 		// we've found a key (probably)
 		if maybeKey != "" {
+			if ap.isRevoked(rd, maybeKey) {
+				return Abort(403, "Access denied. This key has been revoked.").WithCode("key_revoked")
+			}
 			// quick auth: is key in redis?
-			kjson, _ := redis.String(rd.Do("GET", "auth_cache:"+maybeKey))
+			kjson := ""
+			if ap.authCacheTTL > 0 {
+				kjson, _ = redis.String(rd.Do("GET", authCacheKey(maybeKey)))
+			}
 			if kjson != "" {
 				// yes-- proceed immediately
+				stats.authCache.inc("hit")
 				key := Key{}
 				json.Unmarshal([]byte(kjson), &key)
+				if key.Suspended {
+					return Abort(403, "Access denied. This key has been suspended.").WithCode("key_suspended")
+				}
+				sp := ctx.trace.startSpan("auth.validate", spanInternal).set("apiplexy.plugin", pluginName(auth)).set("apiplexy.cached", true)
 				ok, err := auth.Validate(&key, req, ctx, bits)
+				sp.set("apiplexy.valid", ok).finish(err)
+				countPluginError("auth", auth, err)
 				if err != nil {
 					return err
 				}
@@ -112,31 +131,43 @@ func (ap *apiplex) authenticateRequest(req *http.Request, rd redis.Conn, ctx *AP
 					found = true
 					break
 				} else {
-					return Abort(403, fmt.Sprintf("Access denied. Found a key of type '%s', but it is invalid.", key.Type))
+					return Abort(403, fmt.Sprintf("Access denied. Found a key of type '%s', but it is invalid.", key.Type)).WithCode("invalid_key")
 				}
 			} else {
 				// no-- try the backends
+				stats.authCache.inc("miss")
 				for _, bend := range ap.backends {
+					sp := ctx.trace.startSpan("backend.get_key", spanInternal).set("apiplexy.plugin", pluginName(bend))
 					key, err := bend.GetKey(maybeKey, keyType)
+					sp.set("apiplexy.key_found", key != nil).finish(err)
+					countPluginError("backend", bend, err)
 					if err != nil {
 						return err
 					}
 					if key == nil {
 						continue
 					}
+					if key.Suspended {
+						return Abort(403, "Access denied. This key has been suspended.").WithCode("key_suspended")
+					}
+					sp = ctx.trace.startSpan("auth.validate", spanInternal).set("apiplexy.plugin", pluginName(auth)).set("apiplexy.cached", false)
 					ok, err := auth.Validate(key, req, ctx, bits)
+					sp.set("apiplexy.valid", ok).finish(err)
+					countPluginError("auth", auth, err)
 					if err != nil {
 						return err
 					}
 					if ok {
-						kjson, _ := json.Marshal(&key)
-						// TODO error handling if things go wrong in redis?
-						rd.Do("SETEX", "auth_cache:"+maybeKey, ap.authCacheMins*60, string(kjson))
+						if ap.authCacheTTL > 0 {
+							kjson, _ := json.Marshal(&key)
+							// TODO error handling if things go wrong in redis?
+							rd.Do("SETEX", authCacheKey(maybeKey), ap.authCacheTTL, string(kjson))
+						}
 						ctx.Key = key
 						found = true
 						break
 					} else {
-						return Abort(403, fmt.Sprintf("Access denied. Found a key of type '%s', but it is invalid.", key.Type))
+						return Abort(403, fmt.Sprintf("Access denied. Found a key of type '%s', but it is invalid.", key.Type)).WithCode("invalid_key")
 					}
 				}
 			}
@@ -146,11 +177,11 @@ func (ap *apiplex) authenticateRequest(req *http.Request, rd redis.Conn, ctx *AP
 		}
 	}
 	if !found {
-		if ap.allowKeyless {
+		if chains.keyless {
 			ctx.Keyless = true
 			ctx.Key = nil
 		} else {
-			return Abort(403, "Access denied. You or your app must supply valid credentials to access this API.")
+			return Abort(403, "Access denied. You or your app must supply valid credentials to access this API.").WithCode("credentials_required")
 		}
 	}
 	return nil
@@ -181,21 +212,29 @@ func (ap *apiplex) checkQuota(rd redis.Conn, req *http.Request, ctx *APIContext)
 		quotaName = ctx.Key.Quota
 		keyID = ctx.Key.ID
 	}
+	// keys on the default quota get the virtual host's default instead
+	if quotaName == "" || quotaName == "default" {
+		quotaName = ap.defaultQuota(ctx.VHost)
+	}
 	quota, ok := ap.quotas[quotaName]
 	if !ok {
 		// TODO nonexistant quota requested-- this should be reported
-		quota = ap.quotas["default"]
+		quota = ap.quotas[ap.defaultQuota(ctx.VHost)]
 	}
 	if quota.Minutes <= 0 {
 		return nil
 	}
 	if quota.MaxIP > 0 {
 		if ap.overQuota(rd, "quota:ip:"+keyID+":"+ctx.ClientIP, ctx.Cost, quota.MaxIP, quota.Minutes) {
-			return Abort(403, fmt.Sprintf("Request quota per IP exceeded (%d reqs / %d mins). Please wait before making new requests.", quota.MaxIP, quota.Minutes))
+			stats.quotaRejections.inc(quotaName, "ip")
+			return Abort(403, fmt.Sprintf("Request quota per IP exceeded (%d reqs / %d mins). Please wait before making new requests.", quota.MaxIP, quota.Minutes)).
+				WithCode("quota_exceeded").With("limit", quota.MaxIP).With("minutes", quota.Minutes).With("per", "ip")
 		}
 	}
-	if quota.MaxKey > 0 {
+	// keyless requests have no key to count against
+	if quota.MaxKey > 0 && !ctx.Keyless {
 		if ap.overQuota(rd, "quota:key:"+keyID, ctx.Cost, quota.MaxKey, quota.Minutes) {
+			stats.quotaRejections.inc(quotaName, "key")
 			if ctx.Key.Owner != "" {
 				notified, err := redis.Bool(rd.Do("GET", "quota:key:"+keyID+":notified"))
 				if err == nil && notified {
@@ -211,7 +250,8 @@ This warning will repeat every hour as long as the key continues to exceed its q
 					rd.Do("SETEX", "quota:key:"+keyID+":notified", 60*60, true)
 				}
 			}
-			return Abort(403, fmt.Sprintf("Request quota per key exceeded (%d reqs / %d mins). Please wait before making new requests.", quota.MaxKey, quota.Minutes))
+			return Abort(403, fmt.Sprintf("Request quota per key exceeded (%d reqs / %d mins). Please wait before making new requests.", quota.MaxKey, quota.Minutes)).
+				WithCode("quota_exceeded").With("limit", quota.MaxKey).With("minutes", quota.Minutes).With("per", "key")
 		}
 	}
 	return nil
@@ -219,8 +259,14 @@ This warning will repeat every hour as long as the key continues to exceed its q
 
 func prepLog(ctx *APIContext, req *http.Request) {
 	ctx.Log["client_ip"] = ctx.ClientIP
+	if ctx.RequestID != "" {
+		ctx.Log["request_id"] = ctx.RequestID
+	}
 	ctx.Log["path"] = ctx.Path
 	ctx.Log["api_path"] = ctx.APIPath
+	if ctx.VHost != "" {
+		ctx.Log["vhost"] = ctx.VHost
+	}
 	ctx.Log["keyless"] = ctx.Keyless
 	ctx.Log["referrer"] = req.Referer()
 	if !ctx.Keyless {
@@ -232,6 +278,26 @@ func prepLog(ctx *APIContext, req *http.Request) {
 	}
 }
 
+// Runs all logging plugins on a finished request. Logging happens in a goroutine so the
+// request can finish as fast as possible.
+func (ap *apiplex) logRequest(req *http.Request, urs *http.Response, ctx *APIContext) {
+	ap.finishTrace(req, ctx)
+	ap.pendingLogs.Add(1)
+	atomic.AddInt64(&loggingBacklog, 1)
+	go func() {
+		defer ap.pendingLogs.Done()
+		defer atomic.AddInt64(&loggingBacklog, -1)
+		prepLog(ctx, req)
+		for _, logging := range ap.chainsFor(ctx).logging {
+			if err := logging.Log(req, urs, ctx); err != nil {
+				countPluginError("logging", logging, err)
+				ap.reportError(err)
+				return
+			}
+		}
+	}()
+}
+
 func (ap *apiplex) reportUpstreamError(body []byte, req *http.Request, urs *http.Response, ctx *APIContext) {
 	if len(ap.email.AlertsTo) > 0 && (ap.lastAlert == nil || time.Since(*ap.lastAlert) > time.Duration(ap.email.AlertsCooldown)*time.Minute) {
 		now := time.Now()
@@ -248,6 +314,9 @@ func (ap *apiplex) reportUpstreamError(body []byte, req *http.Request, urs *http
 			{"Method", req.Method},
 			{"Request URI", req.RequestURI},
 		}
+		if ctx.RequestID != "" {
+			details = append(details, detail{"Request ID", ctx.RequestID})
+		}
 		if !ctx.Keyless {
 			details = append(details, detail{"Key ID", ctx.Key.ID})
 		}
@@ -272,14 +341,24 @@ func (ap *apiplex) reportUpstreamError(body []byte, req *http.Request, urs *http
 	}
 }
 
-func (ap *apiplex) upstreamRequest(req *http.Request, ctx *APIContext) (*http.Response, error) {
-	// prepare request for backend
+// prepares a copy of the incoming request to be sent on to the upstream backend.
+func (ap *apiplex) prepareUpstream(req *http.Request, ctx *APIContext) *http.Request {
 	outreq := new(http.Request)
 	*outreq = *req
+	u := *req.URL
+	outreq.URL = &u
+	outreq.Header = make(http.Header, len(req.Header))
+	for k, vv := range req.Header {
+		outreq.Header[k] = append([]string(nil), vv...)
+	}
 
 	outreq.URL.Scheme = ctx.Upstream.Address.Scheme
 	outreq.URL.Host = ctx.Upstream.Address.Host
-	outreq.URL.Path = strings.Replace(outreq.URL.Path, ctx.APIPath, ctx.Upstream.Address.Path, 1)
+	var rewrites []*rewriteRule
+	if pool := ap.poolFor(ctx); pool != nil {
+		rewrites = pool.rewrites
+	}
+	rewriteUpstream(outreq, rewrites, ctx.APIPath, ctx.Upstream.Address)
 	outreq.RequestURI = ""
 	outreq.Close = false
 
@@ -294,17 +373,24 @@ func (ap *apiplex) upstreamRequest(req *http.Request, ctx *APIContext) (*http.Re
 		}
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
+	return outreq
+}
 
-	urs, err := ctx.Upstream.Client.Do(outreq)
-	if err != nil {
-		return nil, err
+func (ap *apiplex) upstreamRequest(req *http.Request, ctx *APIContext) (*http.Response, error) {
+	outreq := ap.prepareUpstream(req, ctx)
+	sp := ctx.trace.startSpan("upstream", spanClient).
+		set("http.method", outreq.Method).
+		set("http.url", outreq.URL.String()).
+		set("apiplexy.attempt", ctx.Log["attempts"])
+	if sp != nil {
+		outreq.Header.Set("traceparent", sp.traceparent())
 	}
-	b, err := ioutil.ReadAll(urs.Body)
+	urs, err := ctx.Upstream.Client.Do(outreq)
 	if err != nil {
+		sp.finish(err)
 		return nil, err
 	}
-	urs.Body.Close()
-	urs.Body = ioutil.NopCloser(bytes.NewReader(b))
+	sp.set("http.status_code", urs.StatusCode).finish(nil)
 
 	// clean up reqponse for processing
 	for _, h := range hopHeaders {
@@ -313,6 +399,71 @@ func (ap *apiplex) upstreamRequest(req *http.Request, ctx *APIContext) (*http.Re
 	return urs, nil
 }
 
+// Fails a request fast because no backend on its API path can take it, either because
+// they're all unhealthy or because their circuit breakers are open.
+func (ap *apiplex) unavailable(pool *upstreamPool, res http.ResponseWriter, ctx *APIContext) {
+	if pool != nil && pool.breaker != nil && pool.breaker.Body != "" {
+		res.Header().Set("Content-Type", pool.breaker.ContentType)
+		res.WriteHeader(503)
+		io.WriteString(res, pool.breaker.Body)
+		return
+	}
+	ap.error(503, Abort(503, "The API is temporarily unavailable. Please try again later.").WithCode("unavailable"), res, ctx)
+}
+
+// Copies an upstream body through to the client. Every chunk is flushed as soon as it
+// has been read, so slow or chunked responses reach the client without waiting for the
+// last byte. Returns the number of bytes sent.
+func streamBody(res http.ResponseWriter, body io.Reader) (int64, error) {
+	flusher, canFlush := res.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			w, werr := res.Write(buf[:n])
+			written += int64(w)
+			if werr != nil {
+				return written, werr
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// Fills in the root span of a traced request and sends the trace off. Called when
+// the request is logged, or when HandleAPI returns if it isn't; must not run
+// alongside the logging goroutine, which owns ctx.Log.
+func (ap *apiplex) finishTrace(req *http.Request, ctx *APIContext) {
+	if ctx.trace == nil || ctx.trace.done {
+		return
+	}
+	root := ctx.trace.root
+	root.set("http.method", req.Method)
+	root.set("http.target", ctx.Path)
+	if status, ok := ctx.Log["status"]; ok {
+		root.set("http.status_code", status)
+	}
+	if ctx.APIPath != "" {
+		root.set("apiplexy.api_path", ctx.APIPath)
+	}
+	if ctx.RequestID != "" {
+		root.set("apiplexy.request_id", ctx.RequestID)
+	}
+	if ctx.Key != nil {
+		root.set("apiplexy.key", ctx.Key.ID)
+	}
+	ctx.trace.finish()
+}
+
 // HandleAPI is the main processing function. It receives a request, checks for authentication,
 // calculates quota, runs plugins and then passes the request to an upstream backend. On the
 // returned response, it again runs plugins, and then sends the (possibly modified) result
@@ -335,118 +486,278 @@ func (ap *apiplex) HandleAPI(res http.ResponseWriter, req *http.Request) {
 		Data:     make(map[string]interface{}),
 	}
 
-	var clientIP string
-	if req.Header.Get("X-Forwarded-For") != "" {
-		clientIP = req.Header.Get("X-Forwarded-For")
-	} else {
-		clientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	sw := &statusWriter{ResponseWriter: res}
+	res = sw
+	defer func() {
+		countRequest(&ctx, sw.status, time.Since(requestStart))
+	}()
+
+	ctx.ClientIP = ap.clientIP.resolve(req)
+	if ap.requestIDHeader != "" {
+		ctx.RequestID = ap.requestID(req)
+		req.Header.Set(ap.requestIDHeader, ctx.RequestID)
+		res.Header().Set(ap.requestIDHeader, ctx.RequestID)
+	}
+	if ap.tracer != nil {
+		if ctx.trace = ap.tracer.start(req, "HTTP "+req.Method); ctx.trace != nil {
+			ctx.Log["trace_id"] = hex.EncodeToString(ctx.trace.root.traceID[:])
+			defer ap.finishTrace(req, &ctx)
+		}
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		ctx.ClientCerts = req.TLS.VerifiedChains[0]
 	}
-	clientIP = strings.TrimSpace(strings.Split(clientIP, ",")[0])
-	ctx.ClientIP = clientIP
 
-	for path, backends := range ap.upstreams {
-		if strings.HasPrefix(req.URL.Path, path) {
-			ctx.APIPath = path
-			if len(backends) == 1 {
-				ctx.Upstream = &backends[0]
-			} else {
-				ctx.Upstream = &backends[rand.Intn(len(backends))]
+	vhost := ap.vhostFor(req)
+	ctx.VHost = vhost.name
+	route := vhost.router.match(req)
+	if route == nil {
+		ap.error(404, Abort(404, fmt.Sprintf("There is no API at '%s'.", req.URL.Path)).WithCode("no_api"), res, &ctx)
+		return
+	}
+	ctx.APIPath = route.api
+	pool := route.pool
+	ctx.errors = pool.errors
+
+	// preflights are answered here, before any key or quota comes into it
+	corsDone := false
+	if pool.cors != nil {
+		if isPreflight(req) {
+			if err := pool.cors.preflight(res, req); err != nil {
+				ap.error(403, err, res, &ctx)
 			}
+			return
 		}
+		res.Header().Add("Vary", "Origin")
+		corsDone = pool.cors.decorate(res.Header(), req, nil)
+	}
+
+	// everything from here on (errors included) may be compressed for the client
+	var cw *compressWriter
+	if pool.compress != nil && !isUpgrade(req) {
+		res.Header().Add("Vary", "Accept-Encoding")
+		if enc := pool.compress.negotiate(req.Header.Get("Accept-Encoding")); enc != "" {
+			cw = newCompressWriter(res, pool.compress, enc)
+			defer cw.Close()
+			res = cw
+		}
+	}
+
+	// fail fast (and free of charge) if every backend is down
+	if ctx.Upstream = pool.pick(); ctx.Upstream == nil {
+		ap.unavailable(pool, res, &ctx)
+		return
 	}
 
 	rd := ap.redis.Get()
+	defer rd.Close()
 
-	if err := ap.authenticateRequest(req, rd, &ctx); err != nil {
-		ap.error(500, err, res)
+	chains := pool.chains
+	if err := ap.authenticateRequest(req, rd, &ctx, chains); err != nil {
+		ap.error(500, err, res, &ctx)
 		return
 	}
+	if pool.cors != nil && !corsDone {
+		pool.cors.decorate(res.Header(), req, ctx.Key)
+	}
 
-	for _, postauth := range ap.postauth {
-		if err := postauth.PostAuth(req, &ctx); err != nil {
-			ap.error(500, err, res)
+	for _, postauth := range chains.postauth {
+		sp := ctx.trace.startSpan("postauth", spanInternal).set("apiplexy.plugin", pluginName(postauth))
+		err := postauth.PostAuth(req, &ctx)
+		sp.finish(err)
+		countPluginError("postauth", postauth, err)
+		if err != nil {
+			ap.error(500, err, res, &ctx)
 			return
 		}
 	}
 
-	if err := ap.checkQuota(rd, req, &ctx); err != nil {
-		ap.error(500, err, res)
+	sp := ctx.trace.startSpan("quota", spanInternal).set("apiplexy.cost", ctx.Cost)
+	err := ap.checkQuota(rd, req, &ctx)
+	sp.finish(err)
+	if err != nil {
+		ap.error(500, err, res, &ctx)
 		return
 	}
 
-	for _, preupstream := range ap.preupstream {
-		if err := preupstream.PreUpstream(req, &ctx); err != nil {
-			ap.error(500, err, res)
+	for _, preupstream := range chains.preupstream {
+		sp := ctx.trace.startSpan("preupstream", spanInternal).set("apiplexy.plugin", pluginName(preupstream))
+		err := preupstream.PreUpstream(req, &ctx)
+		sp.finish(err)
+		countPluginError("preupstream", preupstream, err)
+		if err != nil {
+			ap.error(500, err, res, &ctx)
 			return
 		}
 	}
 
 	if ctx.Upstream == nil {
-		ap.error(500, fmt.Errorf("Request to '%s' has no upstream backend set.", ctx.Path), res)
+		ap.error(500, fmt.Errorf("Request to '%s' has no upstream backend set.", ctx.Path), res, &ctx)
 		return
 	}
 
 	// upstream
+	if isUpgrade(req) {
+		if !ap.admit(req, &ctx) {
+			ap.unavailable(pool, res, &ctx)
+			return
+		}
+		ctx.Upstream.acquire()
+		defer ctx.Upstream.release()
+		ap.proxyUpgrade(res, req, &ctx, requestStart)
+		return
+	}
+
+	// cache hits have been charged quota already, but never touch the backend
+	cache := pool.cache
+	if cache != nil && !cache.lookupAllowed(req) {
+		cache = nil
+	}
+	if cache != nil {
+		if entry := cache.lookup(rd, req, &ctx); entry != nil {
+			if pool.cors != nil {
+				stripCORS(entry.Header)
+			}
+			entry.Header.Del(ap.requestIDHeader)
+			ap.serveCached(res, req, &ctx, entry, requestStart)
+			return
+		}
+		res.Header().Set("X-Cache", "MISS")
+	}
+
 	upstreamStart := time.Now()
-	urs, err := ap.upstreamRequest(req, &ctx)
-	if err != nil {
-		ap.error(500, err, res)
+	urs, err := ap.tryUpstreams(req, &ctx, pool)
+	if err == errBreakerOpen {
+		ap.unavailable(pool, res, &ctx)
+		return
+	} else if err != nil {
+		ap.reportRequestError(err, &ctx)
+		ap.error(502, Abort(502, "The API server could not be reached. The error has been reported to technical staff.").WithCode("upstream_unreachable"), res, &ctx)
 		return
 	}
+	defer ctx.Upstream.release()
 
-	for k, vv := range urs.Header {
-		for _, v := range vv {
-			res.Header().Add(k, v)
+	defer urs.Body.Close()
+	ctx.Log["time_api"] = time.Since(upstreamStart).Nanoseconds()
+
+	// the cache gets the headers as the backend sent them, not what plugins add
+	// for this one request
+	var upstreamHeader http.Header
+	if cache != nil {
+		upstreamHeader = make(http.Header, len(urs.Header))
+		for k, vv := range urs.Header {
+			upstreamHeader[k] = append([]string(nil), vv...)
 		}
 	}
 
-	for _, postupstream := range ap.postupstream {
-		if err := postupstream.PostUpstream(req, urs, &ctx); err != nil {
-			ap.error(500, err, res)
+	// only hold the response in memory if some plugin wants to look at it;
+	// plugins always get to see it uncompressed
+	recompress := ""
+	if chains.bufferBody {
+		body, err := ioutil.ReadAll(urs.Body)
+		if err != nil {
+			ap.error(502, err, res, &ctx)
 			return
 		}
+		if enc := decodableEncoding(urs.Header); enc != "" {
+			if body, err = decompress(enc, body); err != nil {
+				ap.error(502, err, res, &ctx)
+				return
+			}
+			urs.Header.Del("Content-Encoding")
+			urs.Header.Del("Content-Length")
+			recompress = enc
+		}
+		urs.Body = ioutil.NopCloser(bytes.NewReader(body))
 	}
 
-	// TODO client abort early, better response processing
-	body, _ := ioutil.ReadAll(urs.Body)
-	urs.Body.Close()
+	for _, postupstream := range chains.postupstream {
+		sp := ctx.trace.startSpan("postupstream", spanInternal).set("apiplexy.plugin", pluginName(postupstream))
+		err := postupstream.PostUpstream(req, urs, &ctx)
+		sp.finish(err)
+		countPluginError("postupstream", postupstream, err)
+		if err != nil {
+			ap.error(500, err, res, &ctx)
+			return
+		}
+	}
 
 	// if something seriously went wrong on the backend, report
 	if urs.StatusCode >= 500 {
+		body, _ := ioutil.ReadAll(io.LimitReader(urs.Body, maxReportedBody))
 		ap.reportUpstreamError(body, req, urs, &ctx)
-		msg := map[string]interface{}{
-			"error":   "Internal API error",
-			"details": "Sorry, something went wrong on the API server. The error has been reported to technical staff.",
-			"code":    urs.StatusCode,
-		}
-		res.WriteHeader(urs.StatusCode)
-		r, _ := json.Marshal(msg)
-		res.Write(r)
+		ap.error(urs.StatusCode, Abort(urs.StatusCode, "Sorry, something went wrong on the API server. The error has been reported to technical staff.").
+			WithCode("upstream_error"), res, &ctx)
 		return
 	}
 
+	if pool.cors != nil {
+		stripCORS(urs.Header)
+	}
+	// the gateway's request ID is on the response already
+	urs.Header.Del(ap.requestIDHeader)
+	for k, vv := range urs.Header {
+		for _, v := range vv {
+			res.Header().Add(k, v)
+		}
+	}
+
+	var body io.Reader = urs.Body
+	if chains.bufferBody {
+		// plugins may have swapped out the body, so recount it
+		b, err := ioutil.ReadAll(urs.Body)
+		if err != nil {
+			ap.error(500, err, res, &ctx)
+			return
+		}
+		// the backend sent it compressed; unless the client gets it compressed
+		// by the gateway anyway, compress it back the same way
+		if recompress != "" && cw == nil && urs.Header.Get("Content-Encoding") == "" {
+			if b, err = compress(recompress, b, gzip.DefaultCompression); err != nil {
+				ap.error(500, err, res, &ctx)
+				return
+			}
+			urs.Header.Set("Content-Encoding", recompress)
+			res.Header().Set("Content-Encoding", recompress)
+		}
+		res.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		body = bytes.NewReader(b)
+	}
+
 	if ctx.Key == nil {
 		res.Header().Set("X-Auth-Type", "No Key")
 	} else {
 		res.Header().Set("X-Auth-Type", ctx.Key.Type)
 	}
+	var capture *cacheCapture
+	ttl, storable := time.Duration(0), false
+	if cache != nil {
+		if ttl, storable = cache.storable(req, &ctx, urs.StatusCode, upstreamHeader); storable {
+			capture = &cacheCapture{max: cache.maxSize}
+			body = io.TeeReader(body, capture)
+		}
+	}
+
 	res.WriteHeader(urs.StatusCode)
-	res.Write(body)
+	written, err := streamBody(res, body)
+	if err != nil {
+		// most likely the client went away; nothing left to send, but log it
+		ctx.Log["stream_error"] = err.Error()
+	} else if capture != nil && !capture.overflow {
+		header := entryHeader(upstreamHeader, urs.Header, ap.requestIDHeader)
+		if err := cache.store(rd, req, &ctx, urs.StatusCode, header, capture.buf, ttl); err != nil {
+			ap.reportError(err)
+		}
+	}
+	if cache != nil {
+		ctx.Log["cache"] = "MISS"
+	}
 
-	// do logging in a goroutine so the request can finish as fast as possible
 	if !ctx.DoNotLog {
 		ctx.Log["status"] = urs.StatusCode
-		ctx.Log["time_api"] = time.Since(upstreamStart).Nanoseconds()
+		ctx.Log["bytes"] = written
 		ctx.Log["time_total"] = time.Since(requestStart).Nanoseconds()
-		go func() {
-			prepLog(&ctx, req)
-			for _, logging := range ap.logging {
-				if err := logging.Log(req, urs, &ctx); err != nil {
-					ap.error(500, err, res)
-					return
-				}
-			}
-		}()
+		ap.logRequest(req, urs, &ctx)
 	}
 
 }
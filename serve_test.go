@@ -0,0 +1,142 @@
+package apiplexy
+
+import (
+	"bytes"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// a postupstream plugin that needs the whole body, and shouts it
+type upcaseBody struct{}
+
+func (p *upcaseBody) DefaultConfig() map[string]interface{}         { return nil }
+func (p *upcaseBody) Configure(config map[string]interface{}) error { return nil }
+func (p *upcaseBody) NeedsBody() bool                               { return true }
+func (p *upcaseBody) PostUpstream(req *http.Request, res *http.Response, ctx *APIContext) error {
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body = ioutil.NopCloser(bytes.NewReader(bytes.ToUpper(b)))
+	return err
+}
+
+// a gateway that sends everything to backend, without keys or quotas
+func proxyTo(backend string, postupstream ...PostUpstreamPlugin) *httptest.Server {
+	chains := &pluginChains{keyless: true, postupstream: postupstream}
+	for _, p := range postupstream {
+		if bp, ok := p.(BufferingPlugin); ok && bp.NeedsBody() {
+			chains.bufferBody = true
+		}
+	}
+	ap := &apiplex{
+		upstreams: make(map[string]*upstreamPool),
+		plugins:   newPluginSet(),
+		chains:    chains,
+		quotas:    map[string]apiplexQuota{"default": {}, "keyless": {}},
+		redis:     &redis.Pool{Dial: func() (redis.Conn, error) { return memoryRedis{}, nil }},
+	}
+	ap.clientIP, _ = newClientIPResolver(nil, nil)
+	config := ApiplexConfig{}
+	config.Serve.Backends = map[string][]string{"/": {backend}}
+	if err := ap.buildVirtualHosts(config, map[string][]interface{}{}); err != nil {
+		panic(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(ap.HandleAPI))
+}
+
+// a backend that sends its first chunk right away and the rest once released
+func slowBackend(release chan bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(" last"))
+	}))
+}
+
+func TestStreaming(t *testing.T) {
+	Convey("Responses should reach the client before the backend is done", t, func() {
+		release := make(chan bool)
+		backend := slowBackend(release)
+		defer backend.Close()
+		gateway := proxyTo(backend.URL)
+		defer gateway.Close()
+		defer close(release)
+
+		rs, err := http.Get(gateway.URL + "/x")
+		So(err, ShouldBeNil)
+		defer rs.Body.Close()
+		first := make(chan string)
+		go func() {
+			buf := make([]byte, 5)
+			io.ReadFull(rs.Body, buf)
+			first <- string(buf)
+		}()
+		select {
+		case chunk := <-first:
+			So(chunk, ShouldEqual, "first")
+		case <-time.After(2 * time.Second):
+			t.Error("The first chunk was held back until the backend finished.")
+		}
+	})
+
+	Convey("Responses should be buffered for plugins that need the body", t, func() {
+		release := make(chan bool)
+		backend := slowBackend(release)
+		defer backend.Close()
+		gateway := proxyTo(backend.URL, &upcaseBody{})
+		defer gateway.Close()
+
+		done := make(chan *http.Response)
+		go func() {
+			rs, _ := http.Get(gateway.URL + "/x")
+			done <- rs
+		}()
+		select {
+		case <-done:
+			t.Error("The response went out before the backend finished.")
+		case <-time.After(200 * time.Millisecond):
+		}
+		close(release)
+		rs := <-done
+		So(rs, ShouldNotBeNil)
+		body, _ := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		So(string(body), ShouldEqual, "FIRST LAST")
+		So(rs.ContentLength, ShouldEqual, int64(10))
+	})
+
+	Convey("A client going away should stop the copy from the backend", t, func() {
+		stopped := make(chan int)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			chunk := bytes.Repeat([]byte("x"), 1024)
+			sent := 0
+			for ; sent < 100000; sent++ {
+				if _, err := w.Write(chunk); err != nil {
+					break
+				}
+				w.(http.Flusher).Flush()
+				time.Sleep(time.Millisecond)
+			}
+			stopped <- sent
+		}))
+		defer backend.Close()
+		gateway := proxyTo(backend.URL)
+		defer gateway.Close()
+
+		rs, err := http.Get(gateway.URL + "/x")
+		So(err, ShouldBeNil)
+		io.ReadFull(rs.Body, make([]byte, 4096))
+		rs.Body.Close()
+		select {
+		case sent := <-stopped:
+			So(sent, ShouldBeLessThan, 100000)
+		case <-time.After(10 * time.Second):
+			t.Error("The backend was still being read after the client went away.")
+		}
+	})
+}
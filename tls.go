@@ -0,0 +1,255 @@
+package apiplexy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCiphers = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// how often certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+type storedCert struct {
+	certFile string
+	keyFile  string
+	modified time.Time
+	cert     *tls.Certificate
+}
+
+// A certStore picks the certificate for a TLS handshake by the server name the client
+// asked for (SNI). The first configured certificate is the default. Certificate files
+// are re-read when they change on disk, so renewed certificates are picked up without
+// a restart.
+type certStore struct {
+	certs     []*storedCert
+	names     map[string]*storedCert
+	lastCheck time.Time
+	mutex     sync.RWMutex
+}
+
+func modTime(files ...string) (time.Time, error) {
+	latest := time.Time{}
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (sc *storedCert) load() error {
+	modified, err := modTime(sc.certFile, sc.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(sc.certFile, sc.keyFile)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	sc.cert = &cert
+	sc.modified = modified
+	return nil
+}
+
+func newCertStore(config []apiplexConfigTLSCert) (*certStore, error) {
+	if len(config) == 0 {
+		return nil, fmt.Errorf("TLS needs at least one certificate.")
+	}
+	cs := &certStore{lastCheck: time.Now()}
+	for _, c := range config {
+		sc := &storedCert{certFile: c.Cert, keyFile: c.Key}
+		if err := sc.load(); err != nil {
+			return nil, fmt.Errorf("Couldn't load TLS certificate '%s': %s", c.Cert, err.Error())
+		}
+		cs.certs = append(cs.certs, sc)
+	}
+	cs.index()
+	return cs, nil
+}
+
+// maps every name a certificate is valid for to the certificate; earlier ones win
+func (cs *certStore) index() {
+	cs.names = make(map[string]*storedCert)
+	for i := len(cs.certs) - 1; i >= 0; i-- {
+		sc := cs.certs[i]
+		names := append([]string{sc.cert.Leaf.Subject.CommonName}, sc.cert.Leaf.DNSNames...)
+		for _, n := range names {
+			if n != "" {
+				cs.names[strings.ToLower(n)] = sc
+			}
+		}
+	}
+}
+
+// reloads certificates whose files have changed; a broken file keeps the old one
+func (cs *certStore) refresh() {
+	cs.mutex.RLock()
+	due := time.Since(cs.lastCheck) >= certCheckInterval
+	cs.mutex.RUnlock()
+	if !due {
+		return
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if time.Since(cs.lastCheck) < certCheckInterval {
+		return
+	}
+	cs.lastCheck = time.Now()
+	changed := false
+	for _, sc := range cs.certs {
+		modified, err := modTime(sc.certFile, sc.keyFile)
+		if err != nil || !modified.After(sc.modified) {
+			continue
+		}
+		if err := sc.load(); err != nil {
+			log.Printf("Couldn't reload TLS certificate '%s', keeping the old one. %s\n", sc.certFile, err.Error())
+			continue
+		}
+		log.Printf("Reloaded TLS certificate '%s'.\n", sc.certFile)
+		changed = true
+	}
+	if changed {
+		cs.index()
+	}
+}
+
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.refresh()
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if sc, ok := cs.names[name]; ok {
+		return sc.cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if sc, ok := cs.names["*"+name[i:]]; ok {
+			return sc.cert, nil
+		}
+	}
+	return cs.certs[0].cert, nil
+}
+
+// BuildTLSConfig creates the TLS configuration for the HTTPS listener from the
+// serve.tls section. Returns nil if TLS isn't configured.
+func BuildTLSConfig(config ApiplexConfig) (*tls.Config, error) {
+	c := config.Serve.TLS
+	if c == nil {
+		return nil, nil
+	}
+	store, err := newCertStore(c.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		GetCertificate: store.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS min_version '%s'. Use 1.0, 1.1, 1.2 or 1.3.", c.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+	for _, name := range c.Ciphers {
+		cipher, ok := tlsCiphers[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown or unsupported TLS cipher '%s'.", name)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, cipher)
+	}
+	if c.ClientCA != "" {
+		pem, err := ioutil.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read client CA bundle: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Client CA bundle contains no usable certificates.")
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if c.ClientAuth != "" {
+		ca, ok := tlsClientAuth[c.ClientAuth]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS client_auth '%s'. Use none, request or require.", c.ClientAuth)
+		}
+		if ca != tls.NoClientCert && tc.ClientCAs == nil {
+			return nil, fmt.Errorf("TLS client_auth '%s' needs a client_ca to verify certificates against.", c.ClientAuth)
+		}
+		tc.ClientAuth = ca
+	}
+	return tc, nil
+}
+
+// TLSPort is the port for HTTPS, 443 unless configured otherwise.
+func TLSPort(config ApiplexConfig) int {
+	if config.Serve.TLS == nil || config.Serve.TLS.Port == 0 {
+		return 443
+	}
+	return config.Serve.TLS.Port
+}
+
+// TLSRedirect returns a handler that sends plain HTTP clients to the same URL on
+// the HTTPS port.
+func TLSRedirect(config ApiplexConfig) http.Handler {
+	port := TLSPort(config)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		http.Redirect(res, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,76 @@
+package apiplexy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writes a self-signed certificate for the given names, returns the config for it
+func writeTestCert(dir, file string, names ...string) apiplexConfigTLSCert {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	c := apiplexConfigTLSCert{Cert: filepath.Join(dir, file+".crt"), Key: filepath.Join(dir, file+".key")}
+	ioutil.WriteFile(c.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(c.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+func servedName(cs *certStore, sni string) string {
+	cert, _ := cs.getCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apiplexy-tls")
+	defer os.RemoveAll(dir)
+	api := writeTestCert(dir, "api", "api.example.com")
+	wild := writeTestCert(dir, "wild", "*.example.org")
+	cs, err := newCertStore([]apiplexConfigTLSCert{api, wild})
+
+	Convey("Certificates should be picked by SNI", t, func() {
+		So(err, ShouldBeNil)
+		So(servedName(cs, "api.example.com"), ShouldEqual, "api.example.com")
+		So(servedName(cs, "API.example.com."), ShouldEqual, "api.example.com")
+		So(servedName(cs, "foo.example.org"), ShouldEqual, "*.example.org")
+	})
+
+	Convey("Unknown names should get the first certificate", t, func() {
+		So(servedName(cs, "other.example.net"), ShouldEqual, "api.example.com")
+		So(servedName(cs, ""), ShouldEqual, "api.example.com")
+	})
+
+	Convey("Changed certificate files should be reloaded", t, func() {
+		writeTestCert(dir, "api", "renewed.example.com")
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(api.Cert, later, later)
+		cs.lastCheck = time.Now().Add(-certCheckInterval)
+		So(servedName(cs, "renewed.example.com"), ShouldEqual, "renewed.example.com")
+	})
+
+	Convey("Client auth should require a CA", t, func() {
+		config := ApiplexConfig{}
+		config.Serve.TLS = &apiplexConfigTLS{Certificates: []apiplexConfigTLSCert{api}, ClientAuth: "require"}
+		_, err := BuildTLSConfig(config)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,463 @@
+package apiplexy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// span kinds, as OTLP numbers them
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// A span is one timed stage of a request: authentication, a plugin, the quota
+// check, the upstream call.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      string
+	trace    *requestTrace
+}
+
+// A requestTrace collects the spans of one request. They're exported together
+// when the request is done.
+type requestTrace struct {
+	tracer *tracer
+	root   *span
+	mutex  sync.Mutex
+	spans  []*span
+	done   bool
+}
+
+// A tracer starts traces for sampled requests and hands finished ones to an
+// exporter.
+type tracer struct {
+	exporter spanExporter
+	service  string
+	sample   float64
+}
+
+type spanExporter interface {
+	export(spans []*span)
+	shutdown()
+}
+
+// Parses a W3C traceparent header (version 00). ok is false if there isn't a
+// usable one.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || traceID == [16]byte{} || parentID == [8]byte{} {
+		return
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// Starts the trace for a request, continuing the client's trace if it sent a
+// traceparent. Returns nil if the request isn't sampled.
+func (t *tracer) start(req *http.Request, name string) *requestTrace {
+	root := &span{name: name, kind: spanServer, start: time.Now(), attrs: make(map[string]interface{})}
+	if traceID, parentID, sampled, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+		if !sampled {
+			return nil
+		}
+		root.traceID, root.parentID = traceID, parentID
+	} else {
+		var r [8]byte
+		rand.Read(r[:])
+		if float64(uint64(r[0])<<8|uint64(r[1]))/65536 >= t.sample {
+			return nil
+		}
+		rand.Read(root.traceID[:])
+	}
+	rand.Read(root.spanID[:])
+	tr := &requestTrace{tracer: t, root: root}
+	root.trace = tr
+	return tr
+}
+
+// Starts a span below the request's root span. Safe to call on a nil trace (for
+// requests that aren't traced); the span is nil then, and so is everything done
+// with it.
+func (tr *requestTrace) startSpan(name string, kind int) *span {
+	if tr == nil {
+		return nil
+	}
+	s := &span{
+		traceID:  tr.root.traceID,
+		parentID: tr.root.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    make(map[string]interface{}),
+		trace:    tr,
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+func (s *span) set(key string, value interface{}) *span {
+	if s != nil {
+		s.attrs[key] = value
+	}
+	return s
+}
+
+// Ends a span, marking it as failed if err isn't nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.trace.mutex.Lock()
+	s.trace.spans = append(s.trace.spans, s)
+	s.trace.mutex.Unlock()
+}
+
+// Ends the root span and exports the whole trace. Only the first call counts.
+func (tr *requestTrace) finish() {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	if tr.done {
+		tr.mutex.Unlock()
+		return
+	}
+	tr.done = true
+	tr.mutex.Unlock()
+
+	tr.root.finish(nil)
+	tr.mutex.Lock()
+	spans := tr.spans
+	tr.spans = nil
+	tr.mutex.Unlock()
+	tr.tracer.exporter.export(spans)
+}
+
+// the type name of a plugin, to tell plugin spans apart
+func pluginName(p interface{}) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", p), "*")
+}
+
+func newTracer(config apiplexConfigTracing) (*tracer, error) {
+	t := &tracer{service: config.ServiceName, sample: config.SampleRate}
+	if t.service == "" {
+		t.service = "apiplexy"
+	}
+	if t.sample == 0 {
+		t.sample = 1
+	} else if t.sample < 0 || t.sample > 1 {
+		return nil, fmt.Errorf("Trace sample rate must be between 0 and 1.")
+	}
+	switch config.Exporter {
+	case "", "otlp":
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("Tracing with OTLP needs the endpoint of a collector, like http://localhost:4318/v1/traces.")
+		}
+		t.exporter = newOTLPExporter(config.Endpoint, config.Headers, t.service)
+	case "file":
+		if config.File == "" {
+			return nil, fmt.Errorf("Tracing to a file needs a file name.")
+		}
+		f, err := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't open trace file: %s", err.Error())
+		}
+		t.exporter = &fileExporter{file: f, service: t.service}
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter '%s'. Use otlp or file.", config.Exporter)
+	}
+	return t, nil
+}
+
+// OTLP/JSON encoding of spans, as accepted by OpenTelemetry collectors on /v1/traces.
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		a := otlpAttribute{Key: k}
+		switch t := v.(type) {
+		case bool:
+			a.Value.BoolValue = &t
+		case int:
+			s := strconv.Itoa(t)
+			a.Value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(t, 10)
+			a.Value.IntValue = &s
+		case float64:
+			a.Value.DoubleValue = &t
+		default:
+			s := fmt.Sprint(t)
+			a.Value.StringValue = &s
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		o.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return o
+}
+
+// an OTLP export request for a batch of spans
+func otlpRequest(service string, spans []*span) map[string]interface{} {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		encoded[i] = s.otlp()
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "apiplexy"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+// Sends spans to an OpenTelemetry collector over OTLP/HTTP (JSON), in batches.
+// If the collector can't keep up, spans are dropped rather than slowing down
+// requests.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+	queue    chan *span
+	stop     chan bool
+	stopped  chan bool
+	once     sync.Once
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+)
+
+func newOTLPExporter(endpoint string, headers map[string]string, service string) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, 8*otlpBatchSize),
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) export(spans []*span) {
+	for _, s := range spans {
+		select {
+		case e.queue <- s:
+		default:
+		}
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.stopped)
+	batch := make([]*span, 0, otlpBatchSize)
+	tick := time.NewTicker(otlpFlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= otlpBatchSize {
+				e.send(batch)
+				batch = batch[:0]
+			}
+		case <-tick.C:
+			if len(batch) > 0 {
+				e.send(batch)
+				batch = batch[:0]
+			}
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					if len(batch) > 0 {
+						e.send(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *otlpExporter) send(batch []*span) {
+	body, err := json.Marshal(otlpRequest(e.service, batch))
+	if err != nil {
+		log.Printf("Couldn't encode spans. %s\n", err.Error())
+		return
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Couldn't export spans. %s\n", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("Couldn't export spans. %s\n", err.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Printf("Trace collector refused %d spans: %s\n", len(batch), res.Status)
+	}
+}
+
+// sends off whatever is still queued
+func (e *otlpExporter) shutdown() {
+	e.once.Do(func() {
+		close(e.stop)
+		<-e.stopped
+	})
+}
+
+// Writes every finished trace to a file, as one OTLP/JSON export request per line.
+type fileExporter struct {
+	file    *os.File
+	service string
+	mutex   sync.Mutex
+}
+
+func (e *fileExporter) export(spans []*span) {
+	line, err := json.Marshal(otlpRequest(e.service, spans))
+	if err != nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.file == nil {
+		return
+	}
+	w := bufio.NewWriter(e.file)
+	w.Write(line)
+	w.WriteString("\n")
+	w.Flush()
+}
+
+func (e *fileExporter) shutdown() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.file != nil {
+		e.file.Close()
+		e.file = nil
+	}
+}
+
+// Keeps finished spans in memory, for tests.
+type memoryExporter struct {
+	mutex sync.Mutex
+	spans []*span
+}
+
+func (e *memoryExporter) export(spans []*span) {
+	e.mutex.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mutex.Unlock()
+}
+
+func (e *memoryExporter) shutdown() {}
@@ -0,0 +1,142 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	mem := &memoryExporter{}
+	tr := &tracer{exporter: mem, service: "apiplexy", sample: 1}
+
+	Convey("Valid traceparent headers should be parsed", t, func() {
+		traceID, parentID, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		So(ok, ShouldBeTrue)
+		So(sampled, ShouldBeTrue)
+		So(fmt.Sprintf("%x", traceID), ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+		So(fmt.Sprintf("%x", parentID), ShouldEqual, "00f067aa0ba902b7")
+
+		for _, h := range []string{
+			"",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		} {
+			_, _, _, ok := parseTraceparent(h)
+			So(ok, ShouldBeFalse)
+		}
+	})
+
+	Convey("Traces should continue the client's trace", t, func() {
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		rt := tr.start(req, "HTTP GET")
+		So(rt, ShouldNotBeNil)
+		So(rt.root.traceparent(), ShouldStartWith, "00-4bf92f3577b34da6a3ce929d0e0e4736-")
+
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		So(tr.start(req, "HTTP GET"), ShouldBeNil)
+	})
+
+	Convey("Untraced requests should be safe to record spans for", t, func() {
+		var rt *requestTrace
+		So(func() {
+			rt.startSpan("quota", spanInternal).set("a", 1).finish(nil)
+			rt.finish()
+		}, ShouldNotPanic)
+	})
+
+	Convey("Finished traces should be exported once, with all their spans", t, func() {
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		rt := tr.start(req, "HTTP GET")
+		rt.startSpan("auth.detect", spanInternal).finish(nil)
+		rt.startSpan("quota", spanInternal).finish(Abort(403, "Over quota."))
+		rt.finish()
+		rt.finish()
+
+		So(mem.spans, ShouldHaveLength, 3)
+		root := mem.spans[2]
+		So(root.name, ShouldEqual, "HTTP GET")
+		So(mem.spans[0].parentID, ShouldEqual, root.spanID)
+		So(mem.spans[1].otlp().Status.Code, ShouldEqual, 2)
+		So(root.otlp().ParentSpanID, ShouldEqual, "")
+		mem.spans = nil
+	})
+
+	Convey("Upstream requests should carry the upstream span's traceparent", t, func() {
+		seen := ""
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r.Header.Get("traceparent")
+		}))
+		defer backend.Close()
+		u, _ := url.Parse(backend.URL)
+
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		ctx := &APIContext{Log: map[string]interface{}{}, Upstream: &APIUpstream{Client: http.DefaultClient, Address: u}}
+		ctx.trace = tr.start(req, "HTTP GET")
+		urs, err := (&apiplex{}).upstreamRequest(req, ctx)
+		So(err, ShouldBeNil)
+		urs.Body.Close()
+		ctx.trace.finish()
+
+		So(mem.spans, ShouldHaveLength, 2)
+		So(mem.spans[0].name, ShouldEqual, "upstream")
+		So(seen, ShouldEqual, mem.spans[0].traceparent())
+		mem.spans = nil
+	})
+
+	Convey("Spans should be sent to the collector as OTLP JSON", t, func() {
+		received := make(chan map[string]interface{}, 1)
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			received <- body
+		}))
+		defer collector.Close()
+
+		otlp, err := newTracer(apiplexConfigTracing{Endpoint: collector.URL + "/v1/traces"})
+		So(err, ShouldBeNil)
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		otlp.start(req, "HTTP GET").finish()
+		otlp.exporter.shutdown()
+
+		body := <-received
+		b, _ := json.Marshal(body)
+		So(string(b), ShouldContainSubstring, `"name":"HTTP GET"`)
+		So(string(b), ShouldContainSubstring, `"service.name"`)
+	})
+
+	Convey("The file exporter should write one line per trace", t, func() {
+		dir, _ := ioutil.TempDir("", "apiplexy-trace")
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "traces.json")
+		ft, err := newTracer(apiplexConfigTracing{Exporter: "file", File: file})
+		So(err, ShouldBeNil)
+		req, _ := http.NewRequest("GET", "http://gateway/x", nil)
+		ft.start(req, "HTTP GET").finish()
+		ft.start(req, "HTTP GET").finish()
+		ft.exporter.shutdown()
+
+		written, _ := ioutil.ReadFile(file)
+		So(strings.Count(string(written), "\n"), ShouldEqual, 2)
+	})
+
+	Convey("Bad tracing configurations should be rejected", t, func() {
+		_, err := newTracer(apiplexConfigTracing{})
+		So(err, ShouldNotBeNil)
+		_, err = newTracer(apiplexConfigTracing{Exporter: "zipkin"})
+		So(err, ShouldNotBeNil)
+		_, err = newTracer(apiplexConfigTracing{Exporter: "file", File: "x", SampleRate: 2})
+		So(err, ShouldNotBeNil)
+	})
+}
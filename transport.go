@@ -0,0 +1,89 @@
+package apiplexy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// How long a backend may take to send its response headers, unless the route says
+// otherwise.
+var defaultResponseHeaderTimeout = 30 * time.Second
+
+// Builds the HTTP client used to talk to the backends of one API path. Unset
+// values fall back to defaults that keep a hung backend from holding on to a
+// request forever, while still allowing long streamed responses: there is no
+// deadline for the whole response unless the route sets a timeout, as that would
+// cut off streams and long polls.
+func buildClient(api string, config *apiplexConfigTransport) (*http.Client, error) {
+	c := apiplexConfigTransport{}
+	if config != nil {
+		c = *config
+	}
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = 10
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = 30
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = 90
+	}
+	headerTimeout := time.Duration(c.ResponseHeaderTimeout) * time.Second
+	if headerTimeout <= 0 {
+		headerTimeout = defaultResponseHeaderTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout: time.Duration(c.ConnectTimeout) * time.Second,
+	}
+	if c.KeepAlive > 0 {
+		dialer.KeepAlive = time.Duration(c.KeepAlive) * time.Second
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.InsecureSkipVerify {
+		log.Printf("WARNING: TLS certificates of the backends for API path '%s' will not be verified.\n", api)
+	}
+	if c.CACert != "" {
+		pem, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA bundle for API path '%s': %s", api, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle for API path '%s' contains no usable certificates.", api)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, fmt.Errorf("Client certificate for API path '%s' needs both client_cert and client_key.", api)
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load client certificate for API path '%s': %s", api, err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  dialer.Dial,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Duration(c.ConnectTimeout) * time.Second,
+		ResponseHeaderTimeout: headerTimeout,
+		MaxIdleConnsPerHost:   c.MaxIdleConns,
+		IdleConnTimeout:       time.Duration(c.IdleTimeout) * time.Second,
+		DisableKeepAlives:     c.KeepAlive < 0,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(c.Timeout) * time.Second,
+	}, nil
+}
@@ -0,0 +1,131 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apiplexy-transport")
+	defer os.RemoveAll(dir)
+	cert := writeTestCert(dir, "backend", "backend.example.com")
+
+	Convey("Clients should get defaults without a transport config", t, func() {
+		client, err := buildClient("/api", nil)
+		So(err, ShouldBeNil)
+		So(client.Timeout, ShouldEqual, time.Duration(0))
+		tr := client.Transport.(*http.Transport)
+		So(tr.TLSHandshakeTimeout, ShouldEqual, 10*time.Second)
+		So(tr.IdleConnTimeout, ShouldEqual, 90*time.Second)
+		So(tr.ResponseHeaderTimeout, ShouldEqual, 30*time.Second)
+		So(tr.DisableKeepAlives, ShouldBeFalse)
+		So(tr.TLSClientConfig.InsecureSkipVerify, ShouldBeFalse)
+		So(tr.TLSClientConfig.RootCAs, ShouldBeNil)
+	})
+
+	Convey("Timeouts should be taken from the config", t, func() {
+		client, _ := buildClient("/api", &apiplexConfigTransport{Timeout: 5, ResponseHeaderTimeout: 2, KeepAlive: -1, MaxIdleConns: 7})
+		tr := client.Transport.(*http.Transport)
+		So(client.Timeout, ShouldEqual, 5*time.Second)
+		So(tr.ResponseHeaderTimeout, ShouldEqual, 2*time.Second)
+		So(tr.DisableKeepAlives, ShouldBeTrue)
+		So(tr.MaxIdleConnsPerHost, ShouldEqual, 7)
+	})
+
+	Convey("Backends that never answer should be cut off by default", t, func() {
+		hang := make(chan bool)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-hang
+		}))
+		defer backend.Close()
+		defer close(hang)
+		defer func(d time.Duration) { defaultResponseHeaderTimeout = d }(defaultResponseHeaderTimeout)
+		defaultResponseHeaderTimeout = 100 * time.Millisecond
+
+		client, _ := buildClient("/api", nil)
+		failed := make(chan error)
+		go func() {
+			_, err := client.Get(backend.URL)
+			failed <- err
+		}()
+		select {
+		case err := <-failed:
+			So(err, ShouldNotBeNil)
+			So(errorKind(err), ShouldEqual, retryTimeout)
+		case <-time.After(2 * time.Second):
+			t.Error("The request to a hung backend didn't time out.")
+		}
+	})
+
+	Convey("Streamed responses should outlast the response header timeout", t, func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			time.Sleep(1200 * time.Millisecond)
+			w.Write([]byte(" last"))
+		}))
+		defer backend.Close()
+		client, _ := buildClient("/api", &apiplexConfigTransport{ResponseHeaderTimeout: 1})
+		rs, err := client.Get(backend.URL)
+		So(err, ShouldBeNil)
+		body, err := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		So(err, ShouldBeNil)
+		So(string(body), ShouldEqual, "first last")
+	})
+
+	Convey("CA bundles should be loaded, and broken ones rejected", t, func() {
+		client, err := buildClient("/api", &apiplexConfigTransport{CACert: cert.Cert})
+		So(err, ShouldBeNil)
+		So(client.Transport.(*http.Transport).TLSClientConfig.RootCAs, ShouldNotBeNil)
+
+		_, err = buildClient("/api", &apiplexConfigTransport{CACert: filepath.Join(dir, "missing.crt")})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "'/api'")
+		_, err = buildClient("/api", &apiplexConfigTransport{CACert: cert.Key})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Client certificates should need a cert and a key that load", t, func() {
+		client, err := buildClient("/api", &apiplexConfigTransport{ClientCert: cert.Cert, ClientKey: cert.Key})
+		So(err, ShouldBeNil)
+		So(client.Transport.(*http.Transport).TLSClientConfig.Certificates, ShouldHaveLength, 1)
+
+		_, err = buildClient("/api", &apiplexConfigTransport{ClientCert: cert.Cert})
+		So(err, ShouldNotBeNil)
+		_, err = buildClient("/api", &apiplexConfigTransport{ClientCert: cert.Key, ClientKey: cert.Cert})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Each API path should get a client of its own, shared by its backends", t, func() {
+		ap := &apiplex{upstreams: make(map[string]*upstreamPool), chains: &pluginChains{}, plugins: newPluginSet()}
+		_, err := ap.buildRoutes("", map[string][]string{
+			"/slow": {"http://a", "http://b"},
+			"/fast": {"http://c"},
+		}, map[string]apiplexConfigRoute{
+			"/slow": {Transport: &apiplexConfigTransport{ResponseHeaderTimeout: 60}},
+			"/fast": {Transport: &apiplexConfigTransport{ResponseHeaderTimeout: 2, InsecureSkipVerify: true}},
+		}, nil, nil, map[string][]interface{}{})
+		So(err, ShouldBeNil)
+		slow, fast := ap.upstreams["/slow"].upstreams, ap.upstreams["/fast"].upstreams
+		So(slow[0].Client == slow[1].Client, ShouldBeTrue)
+		So(slow[0].Client == fast[0].Client, ShouldBeFalse)
+		So(slow[0].Client.Transport.(*http.Transport).ResponseHeaderTimeout, ShouldEqual, 60*time.Second)
+		So(fast[0].Client.Transport.(*http.Transport).ResponseHeaderTimeout, ShouldEqual, 2*time.Second)
+		So(fast[0].Client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify, ShouldBeTrue)
+	})
+
+	Convey("Broken transport settings should fail the route", t, func() {
+		ap := &apiplex{upstreams: make(map[string]*upstreamPool), chains: &pluginChains{}, plugins: newPluginSet()}
+		_, err := ap.buildRoutes("", map[string][]string{"/api": {"http://a"}}, map[string]apiplexConfigRoute{
+			"/api": {Transport: &apiplexConfigTransport{ClientKey: cert.Key}},
+		}, nil, nil, map[string][]interface{}{})
+		So(err, ShouldNotBeNil)
+	})
+}
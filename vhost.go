@@ -0,0 +1,144 @@
+package apiplexy
+
+import (
+	"fmt"
+	"gopkg.in/labstack/echo.v1"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A virtualHost is a set of API paths, static paths and a portal API that only
+// answer to certain host names. The default host (named "") has the paths from
+// the top of the serve section and gets every request no virtual host claims.
+type virtualHost struct {
+	name         string
+	hosts        []string
+	router       *router
+	defaultQuota string
+	config       apiplexConfigVHost
+	mux          *echo.Echo
+}
+
+// the key of an API path's pool in apiplex.upstreams
+func routeKey(vhost, api string) string {
+	if vhost == "" {
+		return api
+	}
+	return vhost + ":" + api
+}
+
+// does a host name match a pattern? Patterns are host names, or wildcards like
+// *.example.com, which match any subdomain (but not example.com itself).
+func hostMatches(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return pattern == host
+}
+
+// sorts host patterns so exact names come before wildcards, and longer wildcards
+// before shorter ones
+type byHostPattern []string
+
+func (s byHostPattern) Len() int      { return len(s) }
+func (s byHostPattern) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byHostPattern) Less(i, j int) bool {
+	wi, wj := strings.HasPrefix(s[i], "*."), strings.HasPrefix(s[j], "*.")
+	if wi != wj {
+		return wj
+	}
+	if len(s[i]) != len(s[j]) {
+		return len(s[i]) > len(s[j])
+	}
+	return s[i] < s[j]
+}
+
+// Sets up the virtual hosts of a configuration, including the default one, and
+// builds their routes.
+func (ap *apiplex) buildVirtualHosts(config ApiplexConfig, reusable map[string][]interface{}) error {
+	ap.vhosts = map[string]*virtualHost{
+		"": {
+			defaultQuota: "default",
+			config: apiplexConfigVHost{
+				Backends:  config.Serve.Backends,
+				Routes:    config.Serve.Routes,
+				Static:    config.Serve.Static,
+				PortalAPI: config.Serve.PortalAPI,
+				AdminAPI:  config.Serve.AdminAPI,
+			},
+		},
+	}
+	ap.hostPatterns = []string{}
+	ap.hostIndex = make(map[string]*virtualHost)
+	for name, vc := range config.Serve.VHosts {
+		if name == "" {
+			return fmt.Errorf("Virtual hosts need a name.")
+		}
+		if len(vc.Hosts) == 0 {
+			return fmt.Errorf("Virtual host '%s' doesn't list any hosts.", name)
+		}
+		vh := &virtualHost{name: name, config: vc, defaultQuota: vc.DefaultQuota}
+		if vh.defaultQuota == "" {
+			vh.defaultQuota = "default"
+		} else if _, ok := config.Quotas[vh.defaultQuota]; !ok {
+			return fmt.Errorf("Virtual host '%s' uses quota '%s' as its default, but there is no such quota.", name, vh.defaultQuota)
+		}
+		for _, h := range vc.Hosts {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if other, ok := ap.hostIndex[h]; ok {
+				return fmt.Errorf("Host '%s' is claimed by virtual hosts '%s' and '%s'.", h, other.name, name)
+			}
+			ap.hostIndex[h] = vh
+			ap.hostPatterns = append(ap.hostPatterns, h)
+			vh.hosts = append(vh.hosts, h)
+		}
+		ap.vhosts[name] = vh
+	}
+	sort.Sort(byHostPattern(ap.hostPatterns))
+
+	ap.upstreams = make(map[string]*upstreamPool)
+	total := 0
+	for _, vh := range ap.vhosts {
+		r, err := ap.buildRoutes(vh.name, vh.config.Backends, vh.config.Routes, config.Serve.CORS, config.Serve.Compression, reusable)
+		if err != nil {
+			if vh.name != "" {
+				return fmt.Errorf("In virtual host '%s': %s", vh.name, err.Error())
+			}
+			return err
+		}
+		vh.router = r
+		total += len(vh.config.Backends)
+	}
+	if total == 0 {
+		return fmt.Errorf("You haven't defined any API backends.")
+	}
+	return nil
+}
+
+// vhostFor finds the virtual host a request is for.
+func (ap *apiplex) vhostFor(req *http.Request) *virtualHost {
+	host := requestHost(req)
+	if vh, ok := ap.hostIndex[host]; ok {
+		return vh
+	}
+	for _, p := range ap.hostPatterns {
+		if hostMatches(p, host) {
+			return ap.hostIndex[p]
+		}
+	}
+	return ap.vhosts[""]
+}
+
+// poolFor returns the backend pool of the API path a request went to.
+func (ap *apiplex) poolFor(ctx *APIContext) *upstreamPool {
+	return ap.upstreams[routeKey(ctx.VHost, ctx.APIPath)]
+}
+
+// the quota for keys without a quota of their own
+func (ap *apiplex) defaultQuota(vhost string) string {
+	if vh, ok := ap.vhosts[vhost]; ok {
+		return vh.defaultQuota
+	}
+	return "default"
+}
@@ -0,0 +1,66 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	config := ApiplexConfig{Quotas: map[string]apiplexQuota{"default": {}, "partner": {}}}
+	config.Serve.Backends = map[string][]string{"/": {"http://default/"}}
+	config.Serve.VHosts = map[string]apiplexConfigVHost{
+		"partner": {
+			Hosts:        []string{"partner-api.example.com", "*.partner.example.com"},
+			Backends:     map[string][]string{"/": {"http://partner/"}},
+			DefaultQuota: "partner",
+		},
+		"beta": {
+			Hosts:    []string{"*.example.com"},
+			Backends: map[string][]string{"/v1": {"http://beta/"}},
+		},
+	}
+	ap := &apiplex{}
+	err := ap.buildVirtualHosts(config, nil)
+
+	vhost := func(host string) string {
+		req, _ := http.NewRequest("GET", "http://"+host+"/v1/x", nil)
+		return ap.vhostFor(req).name
+	}
+
+	Convey("Requests should go to the virtual host for their host name", t, func() {
+		So(err, ShouldBeNil)
+		So(vhost("partner-api.example.com"), ShouldEqual, "partner")
+		So(vhost("PARTNER-API.example.com:8080"), ShouldEqual, "partner")
+		So(vhost("eu.partner.example.com"), ShouldEqual, "partner")
+		So(vhost("other.example.com"), ShouldEqual, "beta")
+	})
+
+	Convey("Unclaimed hosts should go to the default host", t, func() {
+		So(vhost("example.com"), ShouldEqual, "")
+		So(vhost("localhost"), ShouldEqual, "")
+	})
+
+	Convey("Each virtual host should route to its own backends", t, func() {
+		req, _ := http.NewRequest("GET", "http://partner-api.example.com/v1/x", nil)
+		route := ap.vhostFor(req).router.match(req)
+		So(route.pool.upstreams[0].Address.Host, ShouldEqual, "partner")
+		So(ap.upstreams["partner:/"] == route.pool, ShouldBeTrue)
+	})
+
+	Convey("Virtual hosts should have their own default quota", t, func() {
+		So(ap.defaultQuota("partner"), ShouldEqual, "partner")
+		So(ap.defaultQuota("beta"), ShouldEqual, "default")
+		So(ap.defaultQuota(""), ShouldEqual, "default")
+	})
+
+	Convey("Hosts claimed twice should be rejected", t, func() {
+		config.Serve.VHosts["again"] = apiplexConfigVHost{
+			Hosts:    []string{"partner-api.example.com"},
+			Backends: map[string][]string{"/": {"http://again/"}},
+		}
+		err := (&apiplex{}).buildVirtualHosts(config, nil)
+		So(err, ShouldNotBeNil)
+		delete(config.Serve.VHosts, "again")
+	})
+}
@@ -0,0 +1,321 @@
+package apiplexy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Is this a request to switch protocols (most likely to a WebSocket)?
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// opens a raw connection to an upstream backend
+func dialUpstream(u *APIUpstream) (net.Conn, error) {
+	host := u.Address.Host
+	name := host
+	secure := u.Address.Scheme == "https" || u.Address.Scheme == "wss"
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	} else if secure {
+		host = host + ":443"
+	} else {
+		host = host + ":80"
+	}
+	// use the same connection settings as the route's HTTP client
+	dial := (&net.Dialer{Timeout: 10 * time.Second}).Dial
+	tlsConfig := &tls.Config{}
+	if t, ok := u.Client.Transport.(*http.Transport); ok {
+		if t.Dial != nil {
+			dial = t.Dial
+		}
+		if t.TLSClientConfig != nil {
+			tlsConfig = t.TLSClientConfig.Clone()
+		}
+	}
+	conn, err := dial("tcp", host)
+	if err != nil || !secure {
+		return conn, err
+	}
+	tlsConfig.ServerName = name
+	tconn := tls.Client(conn, tlsConfig)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tconn, nil
+}
+
+// A frameCounter follows a stream of WebSocket frames and counts complete data
+// messages. It only looks at frame headers; payloads are skipped over without
+// being decoded.
+type frameCounter struct {
+	header    []byte
+	remaining uint64
+	messages  int64
+}
+
+// length of a frame header, or 0 if we haven't seen enough of it to tell yet
+func frameHeaderLen(h []byte) int {
+	if len(h) < 2 {
+		return 0
+	}
+	n := 2
+	switch h[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func framePayloadLen(h []byte) uint64 {
+	switch l := h[1] & 0x7f; l {
+	case 126:
+		return uint64(h[2])<<8 | uint64(h[3])
+	case 127:
+		var n uint64
+		for _, b := range h[2:10] {
+			n = n<<8 | uint64(b)
+		}
+		return n
+	default:
+		return uint64(l)
+	}
+}
+
+func (fc *frameCounter) feed(p []byte) {
+	for len(p) > 0 {
+		if fc.remaining > 0 {
+			skip := uint64(len(p))
+			if skip > fc.remaining {
+				skip = fc.remaining
+			}
+			p = p[skip:]
+			fc.remaining -= skip
+			continue
+		}
+		fc.header = append(fc.header, p[0])
+		p = p[1:]
+		if n := frameHeaderLen(fc.header); n == 0 || len(fc.header) < n {
+			continue
+		}
+		// final frame of a data (non-control) message
+		if fc.header[0]&0x80 != 0 && fc.header[0]&0x0f < 0x8 {
+			atomic.AddInt64(&fc.messages, 1)
+		}
+		fc.remaining = framePayloadLen(fc.header)
+		fc.header = fc.header[:0]
+	}
+}
+
+// A wsSession is a hijacked client connection piped to an upstream connection.
+type wsSession struct {
+	limits    apiplexConfigWebSocket
+	client    net.Conn
+	upstream  net.Conn
+	bytesIn   int64
+	bytesOut  int64
+	framesIn  *frameCounter
+	framesOut *frameCounter
+	closeOnce sync.Once
+	reason    string
+}
+
+func (ws *wsSession) close(reason string) {
+	ws.closeOnce.Do(func() {
+		ws.reason = reason
+		ws.client.Close()
+		ws.upstream.Close()
+	})
+}
+
+func (ws *wsSession) overQuota() string {
+	if ws.limits.MaxBytes > 0 && atomic.LoadInt64(&ws.bytesIn)+atomic.LoadInt64(&ws.bytesOut) > ws.limits.MaxBytes {
+		return "byte quota exceeded"
+	}
+	if ws.limits.MaxMessages > 0 && ws.framesIn != nil &&
+		atomic.LoadInt64(&ws.framesIn.messages)+atomic.LoadInt64(&ws.framesOut.messages) > ws.limits.MaxMessages {
+		return "message quota exceeded"
+	}
+	return ""
+}
+
+// copies one direction of the connection until either side hangs up or the
+// connection goes over its quota
+func (ws *wsSession) pipe(dst io.Writer, src io.Reader, count *int64, frames *frameCounter, side string) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				ws.close(side + " closed")
+				return
+			}
+			atomic.AddInt64(count, int64(n))
+			if frames != nil {
+				frames.feed(buf[:n])
+			}
+			if reason := ws.overQuota(); reason != "" {
+				ws.close(reason)
+				return
+			}
+		}
+		if rerr != nil {
+			ws.close(side + " closed")
+			return
+		}
+	}
+}
+
+// Proxies an Upgrade request (most likely a WebSocket handshake) to the request's
+// upstream. If the backend agrees to switch protocols, the client connection is
+// hijacked and both connections are piped into each other until one side closes.
+// By the time this is called, the request has been authenticated and charged quota
+// like any other.
+func (ap *apiplex) proxyUpgrade(res http.ResponseWriter, req *http.Request, ctx *APIContext, requestStart time.Time) {
+	hijacker, ok := res.(http.Hijacker)
+	if !ok {
+		ap.error(500, fmt.Errorf("Cannot upgrade connection for '%s': response doesn't support hijacking.", ctx.Path), res, ctx)
+		return
+	}
+
+	outreq := ap.prepareUpstream(req, ctx)
+	if ctx.trace != nil {
+		outreq.Header.Set("traceparent", ctx.trace.root.traceparent())
+	}
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", req.Header.Get("Upgrade"))
+
+	upstreamStart := time.Now()
+	uconn, err := dialUpstream(ctx.Upstream)
+	if err != nil {
+		ap.recordOutcome(req, nil, ctx, false)
+		ap.reportRequestError(err, ctx)
+		ap.error(502, Abort(502, "The API server could not be reached. The error has been reported to technical staff.").WithCode("upstream_unreachable"), res, ctx)
+		return
+	}
+	if err := outreq.Write(uconn); err != nil {
+		uconn.Close()
+		ap.recordOutcome(req, nil, ctx, false)
+		ap.error(502, Abort(502, "The API server could not be reached. The error has been reported to technical staff.").WithCode("upstream_unreachable"), res, ctx)
+		return
+	}
+	ureader := bufio.NewReader(uconn)
+	urs, err := http.ReadResponse(ureader, outreq)
+	if err != nil {
+		uconn.Close()
+		ap.recordOutcome(req, nil, ctx, false)
+		ap.error(502, Abort(502, "The API server sent an invalid response to the upgrade request.").WithCode("upstream_invalid_response"), res, ctx)
+		return
+	}
+	ap.recordOutcome(req, urs, ctx, urs.StatusCode < 500)
+	ctx.Log["time_api"] = time.Since(upstreamStart).Nanoseconds()
+
+	// backend declined to switch protocols; pass its answer on like a normal response
+	if urs.StatusCode != http.StatusSwitchingProtocols {
+		defer uconn.Close()
+		defer urs.Body.Close()
+		for _, h := range hopHeaders {
+			urs.Header.Del(h)
+		}
+		for k, vv := range urs.Header {
+			for _, v := range vv {
+				res.Header().Add(k, v)
+			}
+		}
+		res.WriteHeader(urs.StatusCode)
+		written, _ := streamBody(res, urs.Body)
+		if !ctx.DoNotLog {
+			ctx.Log["status"] = urs.StatusCode
+			ctx.Log["bytes"] = written
+			ctx.Log["time_total"] = time.Since(requestStart).Nanoseconds()
+			ap.logRequest(req, urs, ctx)
+		}
+		return
+	}
+
+	cconn, cbuf, err := hijacker.Hijack()
+	if err != nil {
+		uconn.Close()
+		ap.error(500, err, res, ctx)
+		return
+	}
+	// the server's read/write timeouts don't make sense for a long-lived connection
+	cconn.SetDeadline(time.Time{})
+
+	if err := urs.Write(cconn); err != nil {
+		cconn.Close()
+		uconn.Close()
+		return
+	}
+
+	ws := &wsSession{
+		limits:   ap.websocketLimits(ctx),
+		client:   cconn,
+		upstream: uconn,
+	}
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		ws.framesIn = &frameCounter{}
+		ws.framesOut = &frameCounter{}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		// anything the client already sent after its handshake is waiting in cbuf
+		ws.pipe(uconn, cbuf, &ws.bytesIn, ws.framesIn, "client")
+		wg.Done()
+	}()
+	go func() {
+		ws.pipe(cconn, ureader, &ws.bytesOut, ws.framesOut, "upstream")
+		wg.Done()
+	}()
+	wg.Wait()
+
+	if !ctx.DoNotLog {
+		ctx.Log["status"] = urs.StatusCode
+		ctx.Log["websocket"] = true
+		ctx.Log["ws_duration"] = time.Since(upstreamStart).Nanoseconds()
+		ctx.Log["ws_close_reason"] = ws.reason
+		ctx.Log["bytes_in"] = ws.bytesIn
+		ctx.Log["bytes_out"] = ws.bytesOut
+		if ws.framesIn != nil {
+			ctx.Log["ws_messages_in"] = ws.framesIn.messages
+			ctx.Log["ws_messages_out"] = ws.framesOut.messages
+		}
+		ctx.Log["time_total"] = time.Since(requestStart).Nanoseconds()
+		ap.logRequest(req, urs, ctx)
+	}
+}
+
+func (ap *apiplex) websocketLimits(ctx *APIContext) apiplexConfigWebSocket {
+	if p := ap.poolFor(ctx); p != nil && p.websocket != nil {
+		return *p.websocket
+	}
+	return apiplexConfigWebSocket{}
+}
@@ -0,0 +1,53 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+// builds an unmasked frame with the given first byte and payload length
+func testFrame(first byte, length int) []byte {
+	f := []byte{first}
+	switch {
+	case length < 126:
+		f = append(f, byte(length))
+	case length < 65536:
+		f = append(f, 126, byte(length>>8), byte(length))
+	default:
+		f = append(f, 127, 0, 0, 0, 0, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+	return append(f, make([]byte, length)...)
+}
+
+func TestUpgradeDetection(t *testing.T) {
+	Convey("WebSocket handshakes should be detected as upgrades", t, func() {
+		req, _ := http.NewRequest("GET", "http://example.com/ws", nil)
+		So(isUpgrade(req), ShouldBeFalse)
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "keep-alive, Upgrade")
+		So(isUpgrade(req), ShouldBeTrue)
+	})
+}
+
+func TestFrameCounting(t *testing.T) {
+	Convey("Complete messages should be counted across chunk boundaries", t, func() {
+		stream := []byte{}
+		stream = append(stream, testFrame(0x81, 5)...)     // text message
+		stream = append(stream, testFrame(0x02, 300)...)   // first fragment of a binary message
+		stream = append(stream, testFrame(0x89, 0)...)     // ping
+		stream = append(stream, testFrame(0x80, 70000)...) // last fragment
+		stream = append(stream, testFrame(0x81, 1)...)     // text message
+
+		fc := &frameCounter{}
+		for len(stream) > 0 {
+			n := 7
+			if n > len(stream) {
+				n = len(stream)
+			}
+			fc.feed(stream[:n])
+			stream = stream[n:]
+		}
+		So(fc.messages, ShouldEqual, int64(3))
+	})
+}